@@ -3,405 +3,2108 @@ package main
 import (
 	"archive/zip"
 	"bufio"
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"maps"
+	"math/rand"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/cheggaaa/pb/v3"
+	"github.com/mattn/go-isatty"
+
+	"tex-compiler/pipeline"
+)
+
+const (
+	// How often watch mode checks for changes, and how long files must stay
+	// unchanged before a rebuild starts
+	watchInterval = 500 * time.Millisecond
+	watchDebounce = 300 * time.Millisecond
+
+	// Errors listed after a failed build in watch mode
+	maxReportedErrors = 3
+	// Warnings listed after a failed build
+	maxReportedWarnings = 10
+	// Source lines shown above an error
+	sourceContextLines = 2
+	// TeX hard-wraps its terminal output at this many characters
+	maxPrintLine = 79
+
+	// Waits between attempts when the server is at capacity, doubled every
+	// attempt; jitter adds up to a quarter on top so clients don't retry in step
+	retryBackoff    = 1 * time.Second
+	maxRetryBackoff = 30 * time.Second
+)
+
+// Exit codes, so that scripts can react to each kind of failure
+const (
+	exitCompileFailed = 1 // The document has errors
+	exitUsage         = 2 // Bad flags, arguments or configuration
+	exitNetwork       = 3 // The server couldn't be reached or answered with an error
+	exitOverloaded    = 4 // The server was still at capacity after all retries
+	exitTimeout       = 5 // The compilation or the request took too long
+	exitError         = 6 // Anything else, e.g. the PDF couldn't be saved
 )
 
 type CompileResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
-	LogsURL string `json:"logs_url"`
-	PDFURL  string `json:"pdf_url"`
-	JobID   string `json:"job_id"`
+	Success        bool   `json:"success"`
+	Message        string `json:"message"`
+	LogsURL        string `json:"logs_url"`
+	PDFURL         string `json:"pdf_url"`
+	JobID          string `json:"job_id"`
+	Compiler       string `json:"compiler"`
+	CompilerReason string `json:"compiler_reason"`
+	Draft          bool   `json:"draft"`
+	StatusURL      string `json:"status_url"`
+
+	timedOut bool // The compilation hit the server's or --timeout's limit
+	local    bool // Compiled with the local TeX installation
 }
 
-func main() {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		fmt.Printf("Error getting home directory: %v\n", err)
-		os.Exit(1)
+// Settings from the command line: the first group is sent to the server with
+// every compile request, the rest only affect the client
+type compileOptions struct {
+	compiler    string
+	draft       bool
+	jobname     string
+	macros      macroFlag
+	callbackURL string
+
+	timeout time.Duration
+	retries int
+	output  string
+	log     bool
+	verbose bool
+	local   bool
+}
+
+// Repeatable --macro Name=Value flag
+type macroFlag map[string]string
+
+func (m macroFlag) String() string {
+	pairs := make([]string, 0, len(m))
+	for name, value := range m {
+		pairs = append(pairs, name+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m macroFlag) Set(raw string) error {
+	name, value, ok := strings.Cut(raw, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected Name=Value, got %q", raw)
+	}
+	if pipeline.PredefinedCommand(name, "") {
+		return fmt.Errorf("LaTeX already defines \\%s; use another name", name)
+	}
+	m[name] = value
+	return nil
+}
+
+// Adds the server-side options to a compile request
+func (o *compileOptions) writeFields(writer *multipart.Writer) {
+	if o.compiler != "" {
+		writer.WriteField("compiler", o.compiler)
+	}
+	if o.draft {
+		writer.WriteField("mode", "draft")
+	}
+	if o.jobname != "" {
+		writer.WriteField("jobname", o.jobname)
 	}
-	configDir := filepath.Join(homeDir, ".config", "devh")
-	configFile := filepath.Join(configDir, "tex-compiler.conf")
+	if len(o.macros) > 0 {
+		macros, _ := json.Marshal(o.macros)
+		writer.WriteField("macros", string(macros))
+	}
+	if o.callbackURL != "" {
+		writer.WriteField("callback_url", o.callbackURL)
+	}
+}
 
-	if _, err := os.Stat(configFile); os.IsNotExist(err) {
-		fmt.Println("You can either host it locally/somewhere (repo: https://github.com/S4tyendra/tex-compiler.git) and paste the link (e.g., http://localhost:8080)")
-		fmt.Println("or use the online hosted version at https://tex-compiler.devh.in/ (performance sucks).")
-		fmt.Print("Enter the host for the TeX compiler: ")
-		reader := bufio.NewReader(os.Stdin)
-		host, _ := reader.ReadString('\n')
-		host = strings.TrimSpace(host)
+// Resolves where the PDF for name goes: <name>.pdf in the current directory,
+// inside --output when it is a directory, or --output itself
+func (o *compileOptions) pdfPath(name string) string {
+	if o.output == "" {
+		return name + ".pdf"
+	}
+	if strings.HasSuffix(o.output, "/") || strings.HasSuffix(o.output, string(os.PathSeparator)) {
+		return filepath.Join(o.output, name+".pdf")
+	}
+	if info, err := os.Stat(o.output); err == nil && info.IsDir() {
+		return filepath.Join(o.output, name+".pdf")
+	}
+	return o.output
+}
 
-		if err := os.MkdirAll(configDir, 0755); err != nil {
-			fmt.Printf("Error creating config directory: %v\n", err)
-			os.Exit(1)
-		}
+// The log is saved next to the PDF
+func logPath(pdfPath string) string {
+	return strings.TrimSuffix(pdfPath, filepath.Ext(pdfPath)) + ".log"
+}
+
+// Subcommands by name; any other first argument is a file or directory to compile
+var subcommands = map[string]func(args []string){
+	"compile": runCompile,
+	"config":  runConfig,
+	"health":  runHealth,
+	"jobs":    runJobs,
+	"logs":    runLogs,
+	"fetch":   runFetch,
+}
 
-		if err := ioutil.WriteFile(configFile, []byte(host), 0644); err != nil {
-			fmt.Printf("Error writing config file: %v\n", err)
-			os.Exit(1)
+func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			run(os.Args[2:])
+			return
 		}
+	}
+	runCompile(os.Args[1:])
+}
+
+func printUsage() {
+	fmt.Fprintln(console, "Usage: compile-tex [compile] [options] <file.tex|directory>")
+	fmt.Fprintln(console, "\ncompile-tex <file.tex> -> Upload single file, save as <file>.pdf")
+	fmt.Fprintln(console, "compile-tex <directory> -> Upload directory as zip, save as <directory>.pdf")
+	fmt.Fprintln(console, "compile-tex health -> Show the server's status")
+	fmt.Fprintln(console, "compile-tex jobs -> List the compilations running on the server")
+	fmt.Fprintln(console, "compile-tex logs <job-id> -> Print the log of a recent job")
+	fmt.Fprintln(console, "compile-tex fetch <job-id> -> Download the PDF of a recent job")
+	fmt.Fprintln(console, "compile-tex config ... -> Manage host profiles (run without arguments for help)")
+	fmt.Fprintln(console, "\nFlags:")
+	fmt.Fprintln(console, "  --log : Save log file")
+	fmt.Fprintln(console, "  --main <main.tex> : Specify the main file for directory compilation")
+	fmt.Fprintln(console, "  --watch : Recompile whenever the file or directory changes")
+	fmt.Fprintln(console, "  --verbose : List the files excluded from directory uploads")
+	fmt.Fprintln(console, "  --compiler <name> : Engine to use (see /engines), or auto")
+	fmt.Fprintln(console, "  --draft : Fast single-pass preview build")
+	fmt.Fprintln(console, "  --output <file.pdf|dir/> : Where to save the PDF")
+	fmt.Fprintln(console, "  --timeout <duration> : Give up on the server after this long (e.g. 2m)")
+	fmt.Fprintln(console, "  --retries <n> : Retries when the server is at capacity (default 5)")
+	fmt.Fprintln(console, "  --jobname <name> : Base name for the engine outputs")
+	fmt.Fprintln(console, "  --macro <Name=Value> : Define a macro for the document (repeatable)")
+	fmt.Fprintln(console, "  --callback-url <url> : Queue the job and have the server POST the result to url")
+	fmt.Fprintln(console, "  --profile <name> : Use a host profile other than the default")
+	fmt.Fprintln(console, "  --local : Compile with the local TeX installation instead of the server")
+	fmt.Fprintln(console, "  --json : Print the result and diagnostics as JSON")
+	fmt.Fprintln(console, "\nTEX_COMPILER_HOST and TEX_COMPILER_TOKEN override the profile's host and API key.")
+}
 
-		fmt.Println("Host saved. You can now use the compiler.")
-		if len(os.Args) == 1 {
-			fmt.Println("\nUsage: compile-tex [options] <file.tex|directory>")
-			fmt.Println("\ncompile-tex <file.tex> -> Upload single file, save as <file>.pdf")
-			fmt.Println("compile-tex <directory> -> Upload directory as zip, save as <directory>.pdf")
-			fmt.Println("\nFlags:")
-			fmt.Println("  --log : Save log file")
-			fmt.Println("  --main <main.tex> : Specify the main file for directory compilation")
+// runCompile implements 'compile-tex [compile] [options] <file.tex|directory>'
+func runCompile(args []string) {
+	config, err := loadConfig()
+	if err != nil {
+		fatal(exitUsage, "Error reading config: %v", err)
+	}
+
+	fs := flag.NewFlagSet("compile", flag.ExitOnError)
+	fs.Usage = printUsage
+	opts := &compileOptions{macros: make(macroFlag)}
+	fs.BoolVar(&opts.log, "log", false, "Save log file")
+	mainFileFlag := fs.String("main", "", "Pass the main file via request (when uploading folders)")
+	watchFlag := fs.Bool("watch", false, "Recompile whenever the input changes")
+	fs.BoolVar(&opts.verbose, "verbose", false, "List the files excluded from directory uploads")
+	fs.StringVar(&opts.compiler, "compiler", "", "Engine to use (see /engines), or auto (default: profile or server default)")
+	fs.BoolVar(&opts.draft, "draft", false, "Fast single-pass preview build")
+	fs.StringVar(&opts.output, "output", "", "Output PDF file, or directory to save <name>.pdf in")
+	fs.DurationVar(&opts.timeout, "timeout", 0, "Give up on the server after this long, e.g. 2m (default: no limit)")
+	fs.IntVar(&opts.retries, "retries", 5, "How often to retry when the server is at capacity (0 to fail right away)")
+	fs.StringVar(&opts.jobname, "jobname", "", "Base name for the engine outputs on the server")
+	fs.Var(opts.macros, "macro", "Define a macro as Name=Value (repeatable)")
+	fs.StringVar(&opts.callbackURL, "callback-url", "", "Queue the job and have the server POST the result to this URL")
+	fs.BoolVar(&opts.local, "local", false, "Compile with the TeX installation on this machine instead of the server")
+	fs.BoolVar(&jsonOutput, "json", false, "Print the result and diagnostics as JSON on stdout; messages go to stderr")
+	profileFlag := fs.String("profile", "", "Host profile to use (default: the profile selected with 'config use')")
+	fs.Parse(args)
+
+	if jsonOutput {
+		console = os.Stderr
+		showProgress = false
+		useColor = false
+	}
+
+	if len(config.Profiles) == 0 && os.Getenv("TEX_COMPILER_HOST") == "" && !opts.local {
+		promptForHost(config)
+		if len(args) == 0 {
+			fmt.Fprintln(console)
+			printUsage()
 			os.Exit(0)
 		}
 	}
 
-	logFlag := flag.Bool("log", false, "Save log file")
-	mainFileFlag := flag.String("main", "", "Pass the main file via request (when uploading folders)")
-	flag.Parse()
-
-	if len(flag.Args()) != 1 {
-		fmt.Println("Usage: compile-tex [options] <file.tex|directory>")
-		os.Exit(1)
+	if fs.NArg() != 1 {
+		fatal(exitUsage, "Usage: compile-tex [compile] [options] <file.tex|directory>")
 	}
 
-	inputPath := flag.Arg(0)
+	inputPath := fs.Arg(0)
 
-	host, err := readHostConfig()
-	if err != nil {
-		fmt.Printf("Error reading host config: %v\n", err)
-		os.Exit(1)
+	// Local builds don't need a host, but still take the profile's compiler
+	var host string
+	active, err := config.resolve(*profileFlag)
+	if err != nil && !opts.local {
+		fatal(exitUsage, "Error reading host config: %v", err)
+	}
+	if active != nil {
+		host = active.Host
+		apiKey = active.APIKey
+		if opts.compiler == "" {
+			opts.compiler = active.Compiler
+		}
 	}
 
 	fileInfo, err := os.Stat(inputPath)
 	if err != nil {
-		fmt.Printf("Error getting file info: %v\n", err)
-		os.Exit(1)
+		fatal(exitUsage, "Error getting file info: %v", err)
+	}
+
+	if !fileInfo.IsDir() && !strings.HasSuffix(inputPath, ".tex") {
+		fatal(exitUsage, "Input file must be a .tex file")
 	}
 
-	if fileInfo.IsDir() {
-		compileDirectory(host, inputPath, *mainFileFlag, *logFlag)
+	if *watchFlag && opts.callbackURL != "" {
+		fatal(exitUsage, "--callback-url can't be combined with --watch")
+	}
+	if opts.local && opts.callbackURL != "" {
+		fatal(exitUsage, "--callback-url can't be combined with --local")
+	}
+
+	if *watchFlag {
+		watch(host, inputPath, fileInfo.IsDir(), *mainFileFlag, opts)
+	} else if fileInfo.IsDir() {
+		compileDirectory(host, inputPath, *mainFileFlag, opts)
 	} else {
-		if !strings.HasSuffix(inputPath, ".tex") {
-			fmt.Println("Input file must be a .tex file")
-			os.Exit(1)
-		}
-		compileSingleFile(host, inputPath, *logFlag)
+		compileSingleFile(host, inputPath, opts)
 	}
 }
 
-func readHostConfig() (string, error) {
+// First run: asks for the host and saves it as the default profile. Exits when
+// there is nobody to ask.
+func promptForHost(config *cliConfig) {
+	if !isTerminal(os.Stdin) {
+		fatal(exitUsage, "No host configured. Set TEX_COMPILER_HOST or run: compile-tex config set default host <url>")
+	}
+
+	fmt.Fprintln(console, "You can either host it locally/somewhere (repo: https://github.com/S4tyendra/tex-compiler.git) and paste the link (e.g., http://localhost:8080)")
+	fmt.Fprintln(console, "or use the online hosted version at https://tex-compiler.devh.in/ (performance sucks).")
+	fmt.Fprint(console, "Enter the host for the TeX compiler: ")
+	reader := bufio.NewReader(os.Stdin)
+	host, _ := reader.ReadString('\n')
+	host = strings.TrimSpace(host)
+	if host == "" {
+		fatal(exitUsage, "No host entered.")
+	}
+
+	config.Default = defaultProfile
+	config.Profiles[defaultProfile] = &profile{Host: host}
+	if err := config.save(); err != nil {
+		fatal(exitError, "Error writing config file: %v", err)
+	}
+	fmt.Fprintln(console, "Host saved. You can now use the compiler.")
+}
+
+// A named server to compile against
+type profile struct {
+	Host     string `json:"host"`
+	APIKey   string `json:"api_key,omitempty"`
+	Compiler string `json:"compiler,omitempty"`
+}
+
+// Contents of ~/.config/devh/tex-compiler.json
+type cliConfig struct {
+	Default  string              `json:"default"`
+	Profiles map[string]*profile `json:"profiles"`
+}
+
+// Profile used when none is selected
+const defaultProfile = "default"
+
+// API key of the active profile, sent with every request to the server
+var apiKey string
+
+var (
+	// Human-readable output; stderr with --json, so that stdout only carries the result
+	console io.Writer = os.Stdout
+	// Set by --json
+	jsonOutput bool
+	// Spinners and progress bars are only drawn on a terminal
+	showProgress = isTerminal(os.Stdout)
+)
+
+func configDir() (string, error) {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		return "", err
 	}
-	configFile := filepath.Join(homeDir, ".config", "devh", "tex-compiler.conf")
-	content, err := ioutil.ReadFile(configFile)
+	return filepath.Join(homeDir, ".config", "devh"), nil
+}
+
+// loadConfig reads the profiles. Without a config file, a host saved by
+// earlier versions in tex-compiler.conf becomes the default profile.
+func loadConfig() (*cliConfig, error) {
+	config := &cliConfig{Profiles: make(map[string]*profile)}
+	dir, err := configDir()
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "tex-compiler.json"))
+	if err == nil {
+		if err := json.Unmarshal(content, config); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", filepath.Join(dir, "tex-compiler.json"), err)
+		}
+		if config.Profiles == nil {
+			config.Profiles = make(map[string]*profile)
+		}
+		return config, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	legacy, err := ioutil.ReadFile(filepath.Join(dir, "tex-compiler.conf"))
+	if err == nil && strings.TrimSpace(string(legacy)) != "" {
+		config.Default = defaultProfile
+		config.Profiles[defaultProfile] = &profile{Host: strings.TrimSpace(string(legacy))}
 	}
-	return strings.TrimSpace(string(content)), nil
+	return config, nil
 }
 
-func compileSingleFile(host, filePath string, log bool) {
-	fileContent, err := ioutil.ReadFile(filePath)
+// Writes the config readable by the owner only, as it may hold API keys
+func (c *cliConfig) save() error {
+	dir, err := configDir()
 	if err != nil {
-		fmt.Printf("Error reading file: %v\n", err)
-		os.Exit(1)
+		return err
 	}
-
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	part, err := writer.CreateFormFile("file", filepath.Base(filePath))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(c, "", "  ")
 	if err != nil {
-		fmt.Printf("Error creating form file: %v\n", err)
-		os.Exit(1)
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "tex-compiler.json"), append(content, '\n'), 0600)
+}
+
+// resolve returns the named profile (or the default one) with the
+// TEX_COMPILER_HOST and TEX_COMPILER_TOKEN overrides applied
+func (c *cliConfig) resolve(name string) (*profile, error) {
+	active := &profile{}
+	if name == "" {
+		name = c.Default
+	}
+	if p, ok := c.Profiles[name]; ok {
+		*active = *p
+	} else if name != "" && name != c.Default {
+		return nil, fmt.Errorf("profile %q not found", name)
 	}
-	part.Write(fileContent)
-	writer.Close()
 
-	// Uploading progress
-	fmt.Println("Uploading...")
-	bar := pb.Full.Start(body.Len())
-	bar.Set(pb.Bytes, true)
-	reader := bar.NewProxyReader(body)
+	if host := os.Getenv("TEX_COMPILER_HOST"); host != "" {
+		active.Host = host
+	}
+	if token := os.Getenv("TEX_COMPILER_TOKEN"); token != "" {
+		active.APIKey = token
+	}
+	if active.Host == "" {
+		return nil, fmt.Errorf("no host configured for profile %q", name)
+	}
+	active.Host = strings.TrimRight(active.Host, "/")
+	return active, nil
+}
 
-	url := fmt.Sprintf("%s/compile", host)
-	req, err := http.NewRequest("POST", url, reader)
+// runConfig implements 'compile-tex config ...'
+func runConfig(args []string) {
+	config, err := loadConfig()
 	if err != nil {
-		fmt.Printf("Error creating request: %v\n", err)
-		os.Exit(1)
+		fatal(exitUsage, "Error reading config: %v", err)
 	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
 
-	// Compiling spinner
-	done := make(chan bool)
-	go func() {
-		for {
-			select {
-			case <-done:
-				return
-			default:
-				fmt.Print("\rCompiling... | ")
-				time.Sleep(100 * time.Millisecond)
-				fmt.Print("\rCompiling... / ")
-				time.Sleep(100 * time.Millisecond)
-				fmt.Print("\rCompiling... - ")
-				time.Sleep(100 * time.Millisecond)
-				fmt.Print("\rCompiling... \\ ")
-				time.Sleep(100 * time.Millisecond)
+	if len(args) == 0 {
+		fmt.Fprintln(console, "Usage:")
+		fmt.Fprintln(console, "  compile-tex config list")
+		fmt.Fprintln(console, "  compile-tex config set <profile> <host|api_key|compiler> <value>")
+		fmt.Fprintln(console, "  compile-tex config use <profile>")
+		fmt.Fprintln(console, "  compile-tex config remove <profile>")
+		os.Exit(exitUsage)
+	}
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		names := make([]string, 0, len(config.Profiles))
+		for name := range config.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			p := config.Profiles[name]
+			marker := " "
+			if name == config.Default {
+				marker = "*"
+			}
+			fmt.Fprintf(console, "%s %s\n    host: %s\n", marker, name, p.Host)
+			if p.Compiler != "" {
+				fmt.Fprintf(console, "    compiler: %s\n", p.Compiler)
+			}
+			if p.APIKey != "" {
+				fmt.Fprintf(console, "    api_key: %s\n", maskSecret(p.APIKey))
 			}
 		}
-	}()
+		return
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	close(done)
-	bar.Finish()
-	fmt.Println("\nCompilation finished.")
+	case args[0] == "set" && len(args) == 4:
+		name, key, value := args[1], args[2], args[3]
+		p, ok := config.Profiles[name]
+		if !ok {
+			p = &profile{}
+		}
+		switch key {
+		case "host":
+			p.Host = strings.TrimRight(value, "/")
+		case "api_key":
+			p.APIKey = value
+		case "compiler":
+			p.Compiler = value
+		default:
+			fatal(exitUsage, "Unknown setting %q: use host, api_key or compiler", key)
+		}
+		config.Profiles[name] = p
+		if config.Default == "" {
+			config.Default = name
+		}
+
+	case args[0] == "use" && len(args) == 2:
+		if _, ok := config.Profiles[args[1]]; !ok {
+			fatal(exitUsage, "Profile %q not found", args[1])
+		}
+		config.Default = args[1]
+
+	case args[0] == "remove" && len(args) == 2:
+		if _, ok := config.Profiles[args[1]]; !ok {
+			fatal(exitUsage, "Profile %q not found", args[1])
+		}
+		delete(config.Profiles, args[1])
+		if config.Default == args[1] {
+			config.Default = ""
+		}
+
+	default:
+		runConfig(nil)
+	}
+
+	if err := config.save(); err != nil {
+		fatal(exitError, "Error writing config file: %v", err)
+	}
+	fmt.Fprintln(console, "Config saved.")
+}
+
+// newServerFlags returns the flag set of a subcommand that talks to the server,
+// with the --profile flag every such subcommand has
+func newServerFlags(name, usage string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.SetOutput(console)
+	fs.Usage = func() {
+		fmt.Fprintf(console, "Usage: compile-tex %s\n", usage)
+		fs.PrintDefaults()
+	}
+	profileName := fs.String("profile", "", "Host profile to use (default: the profile selected with 'config use')")
+	return fs, profileName
+}
+
+// connect returns the host of the named (or default) profile and selects its API key
+func connect(profileName string) string {
+	config, err := loadConfig()
 	if err != nil {
-		fmt.Printf("Error sending request: %v\n", err)
-		os.Exit(1)
+		fatal(exitUsage, "Error reading config: %v", err)
 	}
-	defer resp.Body.Close()
+	active, err := config.resolve(profileName)
+	if err != nil {
+		fatal(exitUsage, "Error reading host config: %v", err)
+	}
+	apiKey = active.APIKey
+	return active.Host
+}
 
+// mustGet returns the body of a successful GET request, exiting otherwise
+func mustGet(url string) []byte {
+	resp, err := httpGet(url)
+	if err != nil {
+		fatal(exitCode(err), "Error contacting server: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fatal(exitNetwork, "Error reading server response: %v", err)
+	}
 	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		fmt.Printf("Error from server (%d): %s\n", resp.StatusCode, string(bodyBytes))
-		os.Exit(1)
+		fatal(exitNetwork, "Error from server (%d): %s", resp.StatusCode, strings.TrimSpace(string(body)))
 	}
+	return body
+}
 
-	var compileResp CompileResponse
-	if err := json.NewDecoder(resp.Body).Decode(&compileResp); err != nil {
-		fmt.Printf("Error decoding server response: %v\n", err)
-		os.Exit(1)
+// runHealth implements 'compile-tex health'
+func runHealth(args []string) {
+	fs, profileName := newServerFlags("health", "health [options]")
+	asJSON := fs.Bool("json", false, "Print the server's response as is")
+	fs.Parse(args)
+	host := connect(*profileName)
+
+	body := mustGet(host + "/health")
+	if *asJSON {
+		os.Stdout.Write(body)
+		return
 	}
 
-	if !compileResp.Success {
-		fmt.Printf("Compilation failed: %s\n", compileResp.Message)
-		if log && compileResp.LogsURL != "" {
-			downloadLogs(host, compileResp.LogsURL, strings.TrimSuffix(filepath.Base(filePath), ".tex")+".log")
-		}
-		os.Exit(1)
+	var health struct {
+		Status             string    `json:"status"`
+		RunningJobs        int       `json:"running_jobs"`
+		MaxConcurrent      int       `json:"max_concurrent"`
+		CompilationTimeout string    `json:"compilation_timeout"`
+		Timestamp          time.Time `json:"timestamp"`
+	}
+	if err := json.Unmarshal(body, &health); err != nil {
+		fatal(exitNetwork, "Error decoding server response: %v", err)
 	}
 
-	outputFileName := strings.TrimSuffix(filepath.Base(filePath), ".tex") + ".pdf"
-	downloadPDF(host, compileResp.PDFURL, outputFileName)
+	table := tabwriter.NewWriter(console, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(table, "Host:\t%s\n", host)
+	fmt.Fprintf(table, "Status:\t%s\n", health.Status)
+	fmt.Fprintf(table, "Jobs:\t%d running, at most %d\n", health.RunningJobs, health.MaxConcurrent)
+	fmt.Fprintf(table, "Timeout:\t%s\n", health.CompilationTimeout)
+	fmt.Fprintf(table, "Server time:\t%s\n", health.Timestamp.Local().Format(time.DateTime))
+	table.Flush()
+}
+
+// runJobs implements 'compile-tex jobs'
+func runJobs(args []string) {
+	fs, profileName := newServerFlags("jobs", "jobs [options]")
+	asJSON := fs.Bool("json", false, "Print the server's response as is")
+	fs.Parse(args)
+	host := connect(*profileName)
 
-	if log {
-		downloadLogs(host, compileResp.LogsURL, strings.TrimSuffix(filepath.Base(filePath), ".tex")+".log")
+	body := mustGet(host + "/jobs")
+	if *asJSON {
+		os.Stdout.Write(body)
+		return
 	}
-}
 
-func compileDirectory(host, dirPath, mainFile string, log bool) {
-	if mainFile == "" {
-		if _, err := os.Stat(filepath.Join(dirPath, "main.tex")); os.IsNotExist(err) {
-			fmt.Println("Error: main.tex not found in the directory. Use --main to specify the main file.")
-			os.Exit(1)
-		}
-		mainFile = "main.tex"
+	var jobs struct {
+		RunningJobs   int `json:"running_jobs"`
+		MaxConcurrent int `json:"max_concurrent"`
+		RunningTasks  []struct {
+			JobID         string  `json:"job_id"`
+			MainFile      string  `json:"main_file"`
+			Compiler      string  `json:"compiler"`
+			Draft         bool    `json:"draft"`
+			ElapsedTime   float64 `json:"elapsed_time"`
+			RemainingTime float64 `json:"remaining_time"`
+		} `json:"running_tasks"`
+	}
+	if err := json.Unmarshal(body, &jobs); err != nil {
+		fatal(exitNetwork, "Error decoding server response: %v", err)
 	}
 
-	// Zipping spinner
-	doneZipping := make(chan bool)
-	go func() {
-		for {
-			select {
-			case <-doneZipping:
-				return
-			default:
-				fmt.Print("\rZipping... | ")
-				time.Sleep(100 * time.Millisecond)
-				fmt.Print("\rZipping... / ")
-				time.Sleep(100 * time.Millisecond)
-				fmt.Print("\rZipping... - ")
-				time.Sleep(100 * time.Millisecond)
-				fmt.Print("\rZipping... \\ ")
-				time.Sleep(100 * time.Millisecond)
-			}
+	fmt.Fprintf(console, "%s running, at most %d\n", plural(jobs.RunningJobs, "compilation"), jobs.MaxConcurrent)
+	if len(jobs.RunningTasks) == 0 {
+		return
+	}
+	seconds := func(s float64) string {
+		return time.Duration(s * float64(time.Second)).Round(100 * time.Millisecond).String()
+	}
+	table := tabwriter.NewWriter(console, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "\nJOB ID\tMAIN FILE\tCOMPILER\tDRAFT\tELAPSED\tREMAINING")
+	for _, task := range jobs.RunningTasks {
+		draft := "no"
+		if task.Draft {
+			draft = "yes"
 		}
-	}()
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n", task.JobID, task.MainFile, task.Compiler, draft, seconds(task.ElapsedTime), seconds(task.RemainingTime))
+	}
+	table.Flush()
+}
 
-	buf := new(bytes.Buffer)
-	zipWriter := zip.NewWriter(buf)
+// runLogs implements 'compile-tex logs <job-id>'
+func runLogs(args []string) {
+	fs, profileName := newServerFlags("logs", "logs [options] <job-id>")
+	output := fs.String("output", "", "Save the log to this file instead of printing it")
+	errorsFlag := fs.Bool("errors", false, "Only print the errors and warnings of the final LaTeX pass")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	jobID := fs.Arg(0)
+	host := connect(*profileName)
 
-	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	logData := mustGet(host + "/logs/" + url.PathEscape(jobID) + ".log")
+	switch {
+	case *output != "":
+		if saveLog(logData, *output) == "" {
+			os.Exit(exitError)
 		}
-		if info.IsDir() {
-			return nil
+	case *errorsFlag:
+		report := parseLog(string(logData))
+		if len(report.diagnostics) == 0 {
+			fmt.Fprintln(console, "No errors or warnings")
+			return
 		}
-		relPath, err := filepath.Rel(dirPath, path)
-		if err != nil {
-			return err
+		printDiagnostics(report, "", len(report.diagnostics), false)
+	default:
+		os.Stdout.Write(logData)
+	}
+}
+
+// runFetch implements 'compile-tex fetch <job-id>': downloads the PDF (and log)
+// of a recent job. Callback jobs are looked up first, so that one still running
+// or failed is reported as such.
+func runFetch(args []string) {
+	fs, profileName := newServerFlags("fetch", "fetch [options] <job-id>")
+	opts := &compileOptions{}
+	fs.StringVar(&opts.output, "output", "", "Output PDF file, or directory to save <job-id>.pdf in")
+	fs.BoolVar(&opts.log, "log", false, "Save the log next to the PDF")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	jobID := fs.Arg(0)
+	host := connect(*profileName)
+
+	pdfURL := "/files/" + url.PathEscape(jobID) + ".pdf"
+	logsURL := "/logs/" + url.PathEscape(jobID) + ".log"
+	if resp, err := httpGet(host + "/jobs/" + url.PathEscape(jobID)); err == nil {
+		var status struct {
+			Status string           `json:"status"`
+			Result *CompileResponse `json:"result"`
 		}
-		zipFile, err := zipWriter.Create(relPath)
-		if err != nil {
-			return err
+		if resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&status) == nil {
+			switch {
+			case status.Status == "running":
+				resp.Body.Close()
+				fatal(exitError, "Job %s is still running", jobID)
+			case status.Result != nil && !status.Result.Success:
+				resp.Body.Close()
+				fatal(exitCompileFailed, "Job %s failed: %s", jobID, status.Result.Message)
+			case status.Result != nil:
+				pdfURL, logsURL = status.Result.PDFURL, status.Result.LogsURL
+			}
 		}
-		fsFile, err := os.Open(path)
+		resp.Body.Close()
+	}
+
+	pdfPath := opts.pdfPath(jobID)
+	if err := downloadPDF(host, pdfURL, pdfPath, showProgress); err != nil {
+		fatal(exitCode(err), "Error downloading PDF: %v (artifacts are only kept for a short while after a job finishes)", err)
+	}
+	fmt.Fprintf(console, "Saved %s\n", pdfPath)
+
+	if opts.log {
+		logData, err := fetchLog(host, logsURL)
 		if err != nil {
-			return err
+			fatal(exitCode(err), "Error downloading logs: %v", err)
 		}
-		defer fsFile.Close()
-		_, err = io.Copy(zipFile, fsFile)
-		return err
-	})
+		saveLog(logData, logPath(pdfPath))
+	}
+}
 
+// Shows only the last characters of a secret
+func maskSecret(secret string) string {
+	if len(secret) <= 4 {
+		return "****"
+	}
+	return "****" + secret[len(secret)-4:]
+}
+
+// Reports whether f is an interactive terminal
+func isTerminal(f *os.File) bool {
+	return isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd())
+}
+
+// Sends the API key, if any, as a bearer token
+func authorize(req *http.Request) {
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+}
+
+func httpGet(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		fmt.Printf("Error walking directory: %v\n", err)
-		os.Exit(1)
+		return nil, err
 	}
-	zipWriter.Close()
-	close(doneZipping)
-	fmt.Println("\nZipping finished.")
+	authorize(req)
+	return http.DefaultClient.Do(req)
+}
 
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	part, err := writer.CreateFormFile("file", filepath.Base(dirPath)+".zip")
+func compileSingleFile(host, filePath string, opts *compileOptions) {
+	up, err := singleFileUpload(filePath, opts)
 	if err != nil {
-		fmt.Printf("Error creating form file: %v\n", err)
-		os.Exit(1)
+		fatal(exitUsage, "Error reading file: %v", err)
 	}
-	part.Write(buf.Bytes())
-	writer.WriteField("main", mainFile)
-	writer.Close()
 
-	// Uploading progress
-	fmt.Println("Uploading...")
-	bar := pb.Full.Start(body.Len())
-	bar.Set(pb.Bytes, true)
-	reader := bar.NewProxyReader(body)
+	compileAndSave(host, up, strings.TrimSuffix(filepath.Base(filePath), ".tex"), opts)
+}
 
-	url := fmt.Sprintf("%s/compile", host)
-	req, err := http.NewRequest("POST", url, reader)
+func compileDirectory(host, dirPath, mainFile string, opts *compileOptions) {
+	mainFile, err := resolveMainFile(dirPath, mainFile)
 	if err != nil {
-		fmt.Printf("Error creating request: %v\n", err)
-		os.Exit(1)
+		fatal(exitUsage, "Error: %v", err)
 	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
 
-	// Compiling spinner
-	doneCompiling := make(chan bool)
-	go func() {
-		for {
-			select {
-			case <-doneCompiling:
-				return
-			default:
-				fmt.Print("\rCompiling... | ")
-				time.Sleep(100 * time.Millisecond)
-				fmt.Print("\rCompiling... / ")
-				time.Sleep(100 * time.Millisecond)
-				fmt.Print("\rCompiling... - ")
-				time.Sleep(100 * time.Millisecond)
-				fmt.Print("\rCompiling... \\ ")
-				time.Sleep(100 * time.Millisecond)
-			}
-		}
-	}()
+	files, excluded, err := projectFiles(dirPath, mainFile)
+	if err != nil {
+		fatal(exitUsage, "Error walking directory: %v", err)
+	}
+	if opts.verbose {
+		printExcluded(excluded)
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	close(doneCompiling)
-	bar.Finish()
-	fmt.Println("\nCompilation finished.")
+	up, err := directoryUpload(dirPath, mainFile, files, opts)
 	if err != nil {
-		fmt.Printf("Error sending request: %v\n", err)
-		os.Exit(1)
+		fatal(exitUsage, "Error walking directory: %v", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		fmt.Printf("Error from server (%d): %s\n", resp.StatusCode, string(bodyBytes))
-		os.Exit(1)
+	compileAndSave(host, up, filepath.Base(dirPath), opts)
+}
+
+// Uploads the project and saves the PDF (and log) for name. On failure it prints
+// the errors from the log, with context from the sources, and exits. When the
+// server can't be reached, or with --local, the project is compiled locally.
+func compileAndSave(host string, up *upload, name string, opts *compileOptions) {
+	start := time.Now()
+	pdfPath := opts.pdfPath(name)
+	if opts.local {
+		compileLocallyAndSave(up, pdfPath, start, opts)
+		return
 	}
 
-	var compileResp CompileResponse
-	if err := json.NewDecoder(resp.Body).Decode(&compileResp); err != nil {
-		fmt.Printf("Error decoding server response: %v\n", err)
-		os.Exit(1)
+	compileResp, err := sendCompileWithRetry(host, up, opts, showProgress)
+	if err != nil {
+		if !unreachable(err) || opts.callbackURL != "" {
+			fatal(exitCode(err), "%v", err)
+		}
+		fmt.Fprintln(console, err)
+		fmt.Fprintln(console, "Server unreachable, compiling locally instead")
+		compileLocallyAndSave(up, pdfPath, start, opts)
+		return
 	}
 
+	if compileResp.StatusURL != "" {
+		fmt.Fprintf(console, "Job %s queued; the result will be posted to %s\n", compileResp.JobID, opts.callbackURL)
+		fmt.Fprintf(console, "Status: %s%s\n", host, compileResp.StatusURL)
+		finish(&jsonResult{
+			Success:   true,
+			Message:   "Job queued",
+			JobID:     compileResp.JobID,
+			StatusURL: host + compileResp.StatusURL,
+		})
+		return
+	}
+
+	// The log carries the diagnostics, so it is fetched whenever they are wanted
+	var logData []byte
+	if compileResp.LogsURL != "" && (!compileResp.Success || opts.log || jsonOutput) {
+		logData, _ = fetchLog(host, compileResp.LogsURL)
+	}
 	if !compileResp.Success {
-		fmt.Printf("Compilation failed: %s\n", compileResp.Message)
-		if log && compileResp.LogsURL != "" {
-			downloadLogs(host, compileResp.LogsURL, filepath.Base(dirPath)+".log")
-		}
-		os.Exit(1)
+		reportFailure(compileResp, logData, up.dir, pdfPath, start, opts)
 	}
 
-	outputFileName := filepath.Base(dirPath) + ".pdf"
-	downloadPDF(host, compileResp.PDFURL, outputFileName)
+	if opts.compiler == "auto" && compileResp.Compiler != "" {
+		fmt.Fprintf(console, "Compiled with %s (%s)\n", compileResp.Compiler, compileResp.CompilerReason)
+	}
+
+	fmt.Fprintln(console, "Downloading PDF...")
+	if err := downloadPDF(host, compileResp.PDFURL, pdfPath, showProgress); err != nil {
+		fatal(exitCode(err), "Error downloading PDF: %v", err)
+	}
+	fmt.Fprintf(console, "Successfully compiled and saved %s\n", pdfPath)
 
-	if log {
-		downloadLogs(host, compileResp.LogsURL, filepath.Base(dirPath)+".log")
+	result := compileResult(compileResp, logData, start)
+	result.PDF = pdfPath
+	if opts.log {
+		if logData == nil {
+			fatal(exitNetwork, "Error downloading logs")
+		}
+		result.Log = saveLog(logData, logPath(pdfPath))
 	}
+	finish(result)
 }
 
-func downloadPDF(host, pdfURL, fileName string) {
-	fmt.Println("Downloading PDF...")
-	resp, err := http.Get(host + pdfURL)
+// Compiles the project with the local TeX installation and saves the PDF (and log)
+func compileLocallyAndSave(up *upload, pdfPath string, start time.Time, opts *compileOptions) {
+	compileResp, logData, err := compileLocally(up, pdfPath, opts, showProgress)
 	if err != nil {
-		fmt.Printf("Error downloading PDF: %v\n", err)
-		os.Exit(1)
+		// Without --local this is the fallback for an unreachable server
+		code := exitError
+		if !opts.local {
+			code = exitNetwork
+		}
+		fatal(code, "Local compilation unavailable: %v", err)
 	}
-	defer resp.Body.Close()
 
-	savePDF(resp.Body, fileName, resp.ContentLength)
+	if !compileResp.Success {
+		reportFailure(compileResp, logData, up.dir, pdfPath, start, opts)
+	}
+
+	if opts.compiler == "auto" {
+		fmt.Fprintf(console, "Compiled with %s (%s)\n", compileResp.Compiler, compileResp.CompilerReason)
+	}
+	fmt.Fprintf(console, "Successfully compiled and saved %s\n", pdfPath)
+
+	result := compileResult(compileResp, logData, start)
+	result.PDF = pdfPath
+	if opts.log {
+		result.Log = saveLog(logData, logPath(pdfPath))
+	}
+	finish(result)
 }
 
-func downloadLogs(host, logsURL, fileName string) {
-	fmt.Println("Downloading logs...")
-	resp, err := http.Get(host + logsURL)
-	if err != nil {
-		fmt.Printf("Error downloading logs: %v\n", err)
-		os.Exit(1)
+// Prints why the build failed and the diagnostics from its log, with context
+// from the sources in sourceDir, saves the log if asked to and exits
+func reportFailure(compileResp *CompileResponse, logData []byte, sourceDir, pdfPath string, start time.Time, opts *compileOptions) {
+	fmt.Fprintf(console, "Compilation failed: %s\n", compileResp.Message)
+	result := compileResult(compileResp, logData, start)
+	if logData != nil {
+		fmt.Fprintln(console)
+		printDiagnostics(parseLog(string(logData)), sourceDir, maxReportedWarnings, true)
+		if opts.log {
+			result.Log = saveLog(logData, logPath(pdfPath))
+		}
 	}
-	defer resp.Body.Close()
+	finish(result)
+}
 
-	logData, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Printf("Error reading log data: %v\n", err)
-		os.Exit(1)
+// The outcome of a compile as printed by --json
+type jsonResult struct {
+	Success        bool             `json:"success"`
+	ExitCode       int              `json:"exit_code"`
+	Message        string           `json:"message"`
+	PDF            string           `json:"pdf,omitempty"`
+	Log            string           `json:"log,omitempty"`
+	JobID          string           `json:"job_id,omitempty"`
+	StatusURL      string           `json:"status_url,omitempty"`
+	Compiler       string           `json:"compiler,omitempty"`
+	CompilerReason string           `json:"compiler_reason,omitempty"`
+	Draft          bool             `json:"draft,omitempty"`
+	Local          bool             `json:"local,omitempty"`    // Compiled with the local TeX installation
+	Duration       float64          `json:"duration,omitempty"` // Seconds
+	Errors         int              `json:"errors"`
+	Warnings       int              `json:"warnings"`
+	BadBoxes       int              `json:"bad_boxes"`
+	Diagnostics    []jsonDiagnostic `json:"diagnostics"`
+}
+
+type jsonDiagnostic struct {
+	Severity string `json:"severity"` // error or warning
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Message  string `json:"message"`
+}
+
+// compileResult summarizes a finished compile and the diagnostics in its log
+func compileResult(compileResp *CompileResponse, logData []byte, start time.Time) *jsonResult {
+	result := &jsonResult{
+		Success:        compileResp.Success,
+		Message:        compileResp.Message,
+		JobID:          compileResp.JobID,
+		Compiler:       compileResp.Compiler,
+		CompilerReason: compileResp.CompilerReason,
+		Draft:          compileResp.Draft,
+		Local:          compileResp.local,
+		Duration:       time.Since(start).Round(time.Millisecond).Seconds(),
+	}
+	switch {
+	case compileResp.timedOut:
+		result.ExitCode = exitTimeout
+	case !compileResp.Success:
+		result.ExitCode = exitCompileFailed
 	}
 
-	if err := ioutil.WriteFile(fileName, logData, 0644); err != nil {
-		fmt.Printf("Error writing log file: %v\n", err)
+	report := parseLog(string(logData))
+	result.Errors = report.count(false)
+	result.Warnings = report.count(true)
+	result.BadBoxes = report.badBoxes
+	for _, d := range report.diagnostics {
+		severity := "error"
+		if d.warning {
+			severity = "warning"
+		}
+		result.Diagnostics = append(result.Diagnostics, jsonDiagnostic{
+			Severity: severity,
+			File:     d.file,
+			Line:     d.line,
+			Message:  d.message,
+		})
+	}
+	return result
+}
+
+// finish prints the result with --json and exits with its exit code
+func finish(result *jsonResult) {
+	if jsonOutput {
+		printJSON(result)
+	}
+	os.Exit(result.ExitCode)
+}
+
+// fatal prints the message (and with --json an unsuccessful result) and exits with code
+func fatal(code int, format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	fmt.Fprintln(console, message)
+	if jsonOutput {
+		printJSON(&jsonResult{ExitCode: code, Message: message})
+	}
+	os.Exit(code)
+}
+
+// Writes result to stdout as a single line of JSON
+func printJSON(result *jsonResult) {
+	if result.Diagnostics == nil {
+		result.Diagnostics = []jsonDiagnostic{}
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(result)
+}
+
+// exitCode classifies an error from talking to the server
+func exitCode(err error) int {
+	var overload *overloadError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &overload):
+		return exitOverloaded
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return exitTimeout
 	}
-	fmt.Printf("Logs saved to %s\n", fileName)
+	return exitNetwork
 }
 
-func savePDF(body io.Reader, fileName string, contentLength int64) {
-	outFile, err := os.Create(fileName)
+// Reports whether err means the server could not be reached at all, as opposed
+// to an error reported by a running server
+func unreachable(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// compileLocally runs the server's compile pipeline on a copy of the upload's
+// files in a temporary directory, so the sources stay free of build outputs.
+// On success the PDF is saved to pdfPath. Returns the result and the build log,
+// or an error if the project can't be compiled on this machine at all.
+func compileLocally(up *upload, pdfPath string, opts *compileOptions, progress bool) (*CompileResponse, []byte, error) {
+	mainSource, err := os.ReadFile(filepath.Join(up.dir, filepath.FromSlash(up.mainFile)))
 	if err != nil {
-		fmt.Printf("Error creating output file: %v\n", err)
-		os.Exit(1)
+		return nil, nil, err
+	}
+
+	compiler, reason := opts.compiler, ""
+	switch compiler {
+	case "":
+		compiler = pipeline.DefaultEngine
+	case "auto":
+		sources := make(map[string][]byte)
+		for _, relPath := range up.files {
+			if strings.HasSuffix(relPath, ".tex") && relPath != up.mainFile {
+				if content, err := os.ReadFile(filepath.Join(up.dir, filepath.FromSlash(relPath))); err == nil {
+					sources[relPath] = content
+				}
+			}
+		}
+		compiler, reason = pipeline.DetectEngine(mainSource, sources)
 	}
-	defer outFile.Close()
 
-	// Downloading progress
-	bar := pb.Full.Start64(contentLength)
-	bar.Set(pb.Bytes, true)
-	reader := bar.NewProxyReader(body)
+	var engine *pipeline.Engine
+	var known []string
+	for _, candidate := range pipeline.DefaultEngines() {
+		known = append(known, candidate.Name)
+		if candidate.Name == compiler {
+			engine = candidate
+		}
+	}
+	if engine == nil {
+		return nil, nil, fmt.Errorf("unknown compiler %q (available locally: %s)", compiler, strings.Join(known, ", "))
+	}
+	if !engine.Available() {
+		return nil, nil, fmt.Errorf("%s is not installed on this machine", compiler)
+	}
 
-	_, err = io.Copy(outFile, reader)
+	workDir, err := os.MkdirTemp("", "compile-tex-*")
 	if err != nil {
-		fmt.Printf("Error saving PDF: %v\n", err)
-		os.Exit(1)
+		return nil, nil, err
+	}
+	defer os.RemoveAll(workDir)
+	for _, relPath := range up.files {
+		if err := copyProjectFile(filepath.Join(up.dir, filepath.FromSlash(relPath)), filepath.Join(workDir, filepath.FromSlash(relPath))); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Same format as the server's job logs, so parseLog reads both
+	var logBuf strings.Builder
+	logWriter := func(message string) {
+		fmt.Fprintf(&logBuf, "[%s] %s\n", time.Now().Format("2006-01-02 15:04:05"), message)
+	}
+	logWriter(fmt.Sprintf("Starting compilation - Compiler: %s, Main: %s, Draft: %t", compiler, up.mainFile, opts.draft))
+	if reason != "" {
+		logWriter(fmt.Sprintf("Compiler selected automatically: %s", reason))
+	}
+
+	ctx := context.Background()
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+
+	stopSpinner := func() {}
+	if progress {
+		stopSpinner = startSpinner(fmt.Sprintf("Compiling locally with %s...", compiler))
+	}
+	result := pipeline.Compile(ctx, workDir, up.mainFile, engine, pipeline.Options{
+		Draft:   opts.draft,
+		Jobname: opts.jobname,
+		Macros:  opts.macros,
+	}, logWriter)
+	stopSpinner()
+	if progress {
+		fmt.Fprintln(console)
+	}
+
+	compileResp := &CompileResponse{
+		Success:        result.Success,
+		Message:        result.Message,
+		Compiler:       compiler,
+		CompilerReason: reason,
+		Draft:          opts.draft,
+		local:          true,
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		compileResp.Message = "Compilation timed out"
+		compileResp.timedOut = true
+	}
+	if result.Success {
+		pdfFile, err := os.Open(result.PDFPath)
+		if err == nil {
+			err = savePDF(pdfFile, pdfPath, 0, false)
+			pdfFile.Close()
+		}
+		if err != nil {
+			logWriter(fmt.Sprintf("Failed to save PDF: %v", err))
+			compileResp.Success = false
+			compileResp.Message = "Failed to save PDF"
+		} else {
+			logWriter("Compilation completed successfully")
+		}
+	}
+	return compileResp, []byte(logBuf.String()), nil
+}
+
+// Copies src to dst, creating dst's directory
+func copyProjectFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Falls back to main.tex when no main file was given. Like the server, --main
+// accepts the name with or without .tex; the result always has it.
+func resolveMainFile(dirPath, mainFile string) (string, error) {
+	if mainFile != "" && !strings.HasSuffix(mainFile, ".tex") {
+		mainFile += ".tex"
+	}
+	if mainFile != "" {
+		return mainFile, nil
+	}
+	if _, err := os.Stat(filepath.Join(dirPath, "main.tex")); os.IsNotExist(err) {
+		return "", fmt.Errorf("main.tex not found in the directory. Use --main to specify the main file.")
+	}
+	return "main.tex", nil
+}
+
+// A compile request body, written into the request stream when it is sent (and
+// again for every resend). write passes source file readers through track so
+// that upload progress can be measured against size. The remaining fields
+// describe the files for local builds.
+type upload struct {
+	size  int64 // Total size of the source files
+	write func(writer *multipart.Writer, track func(io.Reader) io.Reader) error
+
+	dir      string   // Directory the file paths are relative to
+	mainFile string   // Root document, relative to dir
+	files    []string // Slash-separated paths relative to dir
+}
+
+// Prepares the upload of a single .tex file
+func singleFileUpload(filePath string, opts *compileOptions) (*upload, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upload{
+		size:     info.Size(),
+		dir:      filepath.Dir(filePath),
+		mainFile: filepath.Base(filePath),
+		files:    []string{filepath.Base(filePath)},
+		write: func(writer *multipart.Writer, track func(io.Reader) io.Reader) error {
+			opts.writeFields(writer)
+			file, err := os.Open(filePath)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			part, err := writer.CreateFormFile("file", filepath.Base(filePath))
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(part, track(file))
+			return err
+		},
+	}, nil
+}
+
+// Prepares the upload of files (slash-separated paths relative to dirPath, as
+// returned by projectFiles) as a ZIP archive that is compressed on the fly
+func directoryUpload(dirPath, mainFile string, files []string, opts *compileOptions) (*upload, error) {
+	var size int64
+	for _, relPath := range files {
+		info, err := os.Stat(filepath.Join(dirPath, filepath.FromSlash(relPath)))
+		if err != nil {
+			return nil, err
+		}
+		size += info.Size()
+	}
+
+	return &upload{
+		size:     size,
+		dir:      dirPath,
+		mainFile: filepath.ToSlash(mainFile),
+		files:    files,
+		write: func(writer *multipart.Writer, track func(io.Reader) io.Reader) error {
+			writer.WriteField("main", mainFile)
+			opts.writeFields(writer)
+			part, err := writer.CreateFormFile("file", filepath.Base(dirPath)+".zip")
+			if err != nil {
+				return err
+			}
+
+			zipWriter := zip.NewWriter(part)
+			for _, relPath := range files {
+				err := func() error {
+					zipFile, err := zipWriter.Create(relPath)
+					if err != nil {
+						return err
+					}
+					fsFile, err := os.Open(filepath.Join(dirPath, filepath.FromSlash(relPath)))
+					if err != nil {
+						return err
+					}
+					defer fsFile.Close()
+					_, err = io.Copy(zipFile, track(fsFile))
+					return err
+				}()
+				if err != nil {
+					return err
+				}
+			}
+			return zipWriter.Close()
+		},
+	}, nil
+}
+
+// Excluded from directory uploads unless re-included by a !pattern in an ignore file
+var defaultIgnores = []string{
+	// Version control, dependencies and OS metadata
+	".git/", ".svn/", ".hg/", "node_modules/", "__MACOSX/", ".DS_Store", "Thumbs.db",
+	// Editor swap and backup files, and our own partial downloads
+	"*.swp", "*.swo", "*~", ".#*", ".*.tmp",
+	// LaTeX build outputs
+	"*.aux", "*.log", "*.out", "*.toc", "*.lof", "*.lot", "*.fls", "*.fdb_latexmk",
+	"*.synctex", "*.synctex.gz", "*.synctex(busy)", "*.bcf", "*.run.xml", "*.blg",
+	"*.dvi", "*.xdv", "*.nav", "*.snm", "*.vrb", "_minted-*/",
+}
+
+// Ignore files read from every directory; later files take precedence
+var ignoreFileNames = []string{".gitignore", ".texcompilerignore"}
+
+// A gitignore-style pattern, scoped to the directory of the file defining it
+type ignoreRule struct {
+	dir     string // slash-separated, "" for the project root
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	source  string // "built-in" or file:line
+}
+
+// A path left out of an upload and the rule responsible
+type exclusion struct {
+	path   string
+	source string
+}
+
+// parseIgnoreRule compiles one line of an ignore file, following .gitignore
+// syntax: # comments, !negation, trailing / for directories only, and patterns
+// containing a slash anchored to dir while others match at any depth
+func parseIgnoreRule(dir, line, source string) (ignoreRule, bool) {
+	pattern := strings.TrimRight(line, " \t\r")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return ignoreRule{}, false
+	}
+
+	rule := ignoreRule{dir: dir, source: source}
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\`) {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return ignoreRule{}, false
+	}
+
+	expr := globToRegexp(strings.TrimPrefix(pattern, "/"))
+	if !strings.Contains(pattern, "/") {
+		expr = "(?:.*/)?" + expr
+	}
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return ignoreRule{}, false
+	}
+	rule.re = re
+	return rule, true
+}
+
+// Translates glob syntax (*, ?, [...] and **) into a regular expression
+func globToRegexp(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[' && strings.IndexByte(pattern[i+1:], ']') > 0:
+			end := i + 1 + strings.IndexByte(pattern[i+1:], ']')
+			class := pattern[i+1 : end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i = end
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	return b.String()
+}
+
+// Reports whether the rule applies to relPath, slash-separated from the project root
+func (r ignoreRule) matches(relPath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.dir != "" {
+		var ok bool
+		if relPath, ok = strings.CutPrefix(relPath, r.dir+"/"); !ok {
+			return false
+		}
+	}
+	return r.re.MatchString(relPath)
+}
+
+// projectFiles lists the files below dirPath to upload as slash-separated paths,
+// along with what the ignore rules left out. The last matching rule wins. As
+// in git, files inside an excluded directory can't be re-included.
+func projectFiles(dirPath, mainFile string) ([]string, []exclusion, error) {
+	var rules []ignoreRule
+	addRule := func(dir, line, source string) {
+		if rule, ok := parseIgnoreRule(dir, line, source); ok {
+			rules = append(rules, rule)
+		}
+	}
+	for _, pattern := range defaultIgnores {
+		addRule("", pattern, "built-in")
+	}
+	// PDFs left over from earlier compiles of this project
+	addRule("", "/"+filepath.Base(dirPath)+".pdf", "built-in")
+	addRule("", "/"+strings.TrimSuffix(filepath.ToSlash(mainFile), ".tex")+".pdf", "built-in")
+
+	var files []string
+	var excluded []exclusion
+	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dirPath, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		if relPath != "." {
+			ignored, source := false, ""
+			for _, rule := range rules {
+				if rule.matches(relPath, info.IsDir()) {
+					ignored, source = !rule.negate, rule.source
+				}
+			}
+			if ignored && info.IsDir() {
+				excluded = append(excluded, exclusion{path: relPath + "/", source: source})
+				return filepath.SkipDir
+			}
+			if ignored {
+				excluded = append(excluded, exclusion{path: relPath, source: source})
+				return nil
+			}
+		}
+
+		if !info.IsDir() {
+			files = append(files, relPath)
+			return nil
+		}
+		dir := strings.TrimPrefix(relPath, ".")
+		for _, name := range ignoreFileNames {
+			content, err := ioutil.ReadFile(filepath.Join(path, name))
+			if err != nil {
+				continue
+			}
+			source := strings.TrimPrefix(dir+"/"+name, "/")
+			for i, line := range strings.Split(string(content), "\n") {
+				addRule(dir, line, fmt.Sprintf("%s:%d", source, i+1))
+			}
+		}
+		return nil
+	})
+	return files, excluded, err
+}
+
+func printExcluded(excluded []exclusion) {
+	for _, e := range excluded {
+		fmt.Fprintf(console, "Excluded %s (%s)\n", e.path, e.source)
+	}
+	fmt.Fprintf(console, "%s excluded from the upload\n", plural(len(excluded), "path"))
+}
+
+// sendCompile streams the upload to /compile with chunked transfer encoding, so
+// the project is never held in memory. Failed compilations come back as a
+// CompileResponse with Success unset; transport and server errors as an error.
+func sendCompile(host string, up *upload, timeout time.Duration, progress bool) (*CompileResponse, error) {
+	track := func(r io.Reader) io.Reader { return r }
+	stopCompiling := func() {}
+	if progress {
+		// Uploading progress
+		fmt.Fprintln(console, "Uploading...")
+		bar := pb.Full.Start64(up.size)
+		bar.Set(pb.Bytes, true)
+		track = func(r io.Reader) io.Reader { return bar.NewProxyReader(r) }
+
+		stopSpinner := startSpinner("Compiling...")
+		stopCompiling = func() {
+			stopSpinner()
+			bar.Finish()
+			fmt.Fprintln(console, "\nCompilation finished.")
+		}
+	}
+
+	bodyReader, bodyWriter := io.Pipe()
+	writer := multipart.NewWriter(bodyWriter)
+	go func() {
+		err := up.write(writer, track)
+		if err == nil {
+			err = writer.Close()
+		}
+		bodyWriter.CloseWithError(err)
+	}()
+
+	url := fmt.Sprintf("%s/compile", host)
+	req, err := http.NewRequest("POST", url, bodyReader)
+	if err != nil {
+		bodyReader.Close()
+		stopCompiling()
+		return nil, fmt.Errorf("Error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	authorize(req)
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	stopCompiling()
+	if err != nil {
+		return nil, fmt.Errorf("Error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading server response: %v", err)
+	}
+
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		overload := &overloadError{}
+		if err := json.Unmarshal(bodyBytes, overload); err == nil && overload.RunningTasks != nil {
+			return nil, overload
+		}
+	}
+
+	// LaTeX errors and timeouts are reported with a non-200 status and a JSON
+	// result; queued callback jobs with 202 and a job ID
+	var compileResp CompileResponse
+	if err := json.Unmarshal(bodyBytes, &compileResp); err != nil || compileResp.JobID == "" {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Error from server (%d): %s", resp.StatusCode, strings.TrimSpace(string(bodyBytes)))
+		}
+		return nil, fmt.Errorf("Error decoding server response: %v", err)
+	}
+	compileResp.timedOut = resp.StatusCode == http.StatusRequestTimeout
+	return &compileResp, nil
+}
+
+// The 503 response of a server running its maximum number of compilations
+type overloadError struct {
+	Message       string `json:"message"`
+	QueuePosition int    `json:"queue_position"` // Not reported by every server
+	RunningTasks  []struct {
+		JobID         string  `json:"job_id"`
+		RemainingTime float64 `json:"remaining_time"`
+	} `json:"running_tasks"`
+}
+
+func (e *overloadError) Error() string {
+	return "Server overloaded: " + e.Message
+}
+
+// Time until the first running compilation is expected to finish at the latest
+func (e *overloadError) soonestSlot() time.Duration {
+	soonest := -1.0
+	for _, task := range e.RunningTasks {
+		if soonest < 0 || task.RemainingTime < soonest {
+			soonest = task.RemainingTime
+		}
+	}
+	return time.Duration(max(soonest, 0) * float64(time.Second))
+}
+
+// sendCompileWithRetry calls sendCompile, retrying up to opts.retries times
+// while the server is at capacity. Each wait lasts until the soonest running
+// compilation should finish, and at least the exponential backoff, plus jitter.
+func sendCompileWithRetry(host string, up *upload, opts *compileOptions, progress bool) (*CompileResponse, error) {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		compileResp, err := sendCompile(host, up, opts.timeout, progress)
+		var overload *overloadError
+		if !errors.As(err, &overload) || attempt > opts.retries {
+			return compileResp, err
+		}
+
+		wait := max(overload.soonestSlot(), backoff)
+		wait += time.Duration(rand.Int63n(int64(wait)/4 + 1))
+		backoff = min(backoff*2, maxRetryBackoff)
+
+		status := fmt.Sprintf("%s running", plural(len(overload.RunningTasks), "compilation"))
+		if overload.QueuePosition > 0 {
+			status += fmt.Sprintf(", queue position %d", overload.QueuePosition)
+		}
+		fmt.Fprintf(console, "Server busy (%s); retrying in %s (%d/%d)\n", status, wait.Round(100*time.Millisecond), attempt, opts.retries)
+		time.Sleep(wait)
+	}
+}
+
+// Prints a spinner after label until the returned function is called
+func startSpinner(label string) func() {
+	done := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		for {
+			for _, frame := range []string{"|", "/", "-", "\\"} {
+				select {
+				case <-done:
+					return
+				default:
+					fmt.Fprintf(console, "\r%s %s ", label, frame)
+					time.Sleep(100 * time.Millisecond)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// downloadPDF saves the PDF next to fileName and renames it into place, so
+// viewers watching fileName never see a partially written file
+func downloadPDF(host, pdfURL, fileName string, progress bool) error {
+	resp, err := httpGet(host + pdfURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	return savePDF(resp.Body, fileName, resp.ContentLength, progress)
+}
+
+// Writes the log to fileName, returning the path or "" if it couldn't be saved
+func saveLog(logData []byte, fileName string) string {
+	if err := ioutil.WriteFile(fileName, logData, 0644); err != nil {
+		fmt.Fprintf(console, "Error writing log file: %v\n", err)
+		return ""
+	}
+	fmt.Fprintf(console, "Logs saved to %s\n", fileName)
+	return fileName
+}
+
+func fetchLog(host, logsURL string) ([]byte, error) {
+	resp, err := httpGet(host + logsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func savePDF(body io.Reader, fileName string, contentLength int64, progress bool) error {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if progress {
+		// Downloading progress
+		bar := pb.Full.Start64(contentLength)
+		bar.Set(pb.Bytes, true)
+		body = bar.NewProxyReader(body)
+		defer bar.Finish()
+	}
+
+	_, err = io.Copy(tmpFile, body)
+	if err == nil {
+		err = tmpFile.Chmod(0644)
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), fileName)
+}
+
+// watch compiles the input, then recompiles whenever a file below it changes.
+// Changes are debounced so that saving several files triggers a single build.
+func watch(host, inputPath string, isDir bool, mainFile string, opts *compileOptions) {
+	pdfPath := opts.pdfPath(strings.TrimSuffix(filepath.Base(inputPath), ".tex"))
+	if isDir {
+		var err error
+		if mainFile, err = resolveMainFile(inputPath, mainFile); err != nil {
+			fatal(exitUsage, "Error: %v", err)
+		}
+	}
+
+	// Our own outputs may live inside the watched directory
+	ignored := make(map[string]bool)
+	for _, output := range []string{pdfPath, logPath(pdfPath)} {
+		if abs, err := filepath.Abs(output); err == nil {
+			ignored[abs] = true
+		}
+	}
+
+	if isDir && opts.verbose {
+		if _, excluded, err := projectFiles(inputPath, mainFile); err == nil {
+			printExcluded(excluded)
+		}
+	}
+
+	fmt.Fprintf(console, "Watching %s for changes. Press Ctrl+C to stop.\n", inputPath)
+	state, _ := snapshotFiles(inputPath, isDir, mainFile, ignored)
+	watchBuild(host, inputPath, isDir, mainFile, pdfPath, opts)
+
+	for {
+		time.Sleep(watchInterval)
+		current, err := snapshotFiles(inputPath, isDir, mainFile, ignored)
+		if err != nil || maps.Equal(current, state) {
+			continue
+		}
+
+		// Wait for the files to settle before building
+		for {
+			time.Sleep(watchDebounce)
+			next, err := snapshotFiles(inputPath, isDir, mainFile, ignored)
+			if err == nil && maps.Equal(next, current) {
+				break
+			}
+			current = next
+		}
+		state = current
+		watchBuild(host, inputPath, isDir, mainFile, pdfPath, opts)
+	}
+}
+
+// Directory the uploaded paths are relative to
+func sourceDir(inputPath string, isDir bool) string {
+	if isDir {
+		return inputPath
+	}
+	return filepath.Dir(inputPath)
+}
+
+func errorsOnly(diagnostics []diagnostic) []diagnostic {
+	var result []diagnostic
+	for _, d := range diagnostics {
+		if !d.warning {
+			result = append(result, d)
+		}
+	}
+	return result
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Records the modification time and size of every watched file: the input
+// file, or the files a directory upload would include. Paths in ignored
+// (our own outputs) are skipped.
+func snapshotFiles(inputPath string, isDir bool, mainFile string, ignored map[string]bool) (map[string]fileStamp, error) {
+	paths := []string{inputPath}
+	if isDir {
+		files, _, err := projectFiles(inputPath, mainFile)
+		if err != nil {
+			return nil, err
+		}
+		paths = paths[:0]
+		for _, relPath := range files {
+			paths = append(paths, filepath.Join(inputPath, filepath.FromSlash(relPath)))
+		}
+	}
+
+	snapshot := make(map[string]fileStamp, len(paths))
+	for _, path := range paths {
+		if abs, err := filepath.Abs(path); err == nil && ignored[abs] {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		snapshot[path] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	return snapshot, nil
+}
+
+// Runs one build in watch mode and prints a one-line summary, plus the first
+// errors when it fails; with --json also a line of JSON per build. Nothing here
+// exits; the next change triggers a retry.
+func watchBuild(host, inputPath string, isDir bool, mainFile, pdfPath string, opts *compileOptions) {
+	start := time.Now()
+	stamp := start.Format("15:04:05")
+	fail := func(code int, format string, args ...any) {
+		message := fmt.Sprintf(format, args...)
+		fmt.Fprintf(console, "[%s] ✗ %s\n", stamp, message)
+		if jsonOutput {
+			printJSON(&jsonResult{ExitCode: code, Message: message})
+		}
+	}
+
+	var up *upload
+	var err error
+	if isDir {
+		var files []string
+		if files, _, err = projectFiles(inputPath, mainFile); err == nil {
+			up, err = directoryUpload(inputPath, mainFile, files, opts)
+		}
+	} else {
+		up, err = singleFileUpload(inputPath, opts)
+	}
+	if err != nil {
+		fail(exitUsage, "Could not read %s: %v", inputPath, err)
+		return
+	}
+
+	var compileResp *CompileResponse
+	var logData []byte
+	local := opts.local
+	if !local {
+		compileResp, err = sendCompileWithRetry(host, up, opts, false)
+		if unreachable(err) {
+			fmt.Fprintf(console, "[%s] Server unreachable, building locally\n", stamp)
+			local = true
+		} else if err != nil {
+			fail(exitCode(err), "%v", err)
+			return
+		} else if compileResp.LogsURL != "" {
+			logData, _ = fetchLog(host, compileResp.LogsURL)
+		}
+	}
+	if local {
+		if compileResp, logData, err = compileLocally(up, pdfPath, opts, false); err != nil {
+			fail(exitError, "Local compilation unavailable: %v", err)
+			return
+		}
+	}
+
+	var report logReport
+	if logData != nil {
+		report = parseLog(string(logData))
+		if opts.log {
+			ioutil.WriteFile(logPath(pdfPath), logData, 0644)
+		}
+	}
+	elapsed := time.Since(start).Round(100 * time.Millisecond)
+
+	if !compileResp.Success {
+		fmt.Fprintf(console, "[%s] ✗ Build failed after %s: %s%s\n", stamp, elapsed, compileResp.Message, report)
+		printDiagnostics(logReport{diagnostics: errorsOnly(report.diagnostics)}, sourceDir(inputPath, isDir), maxReportedErrors, false)
+		if jsonOutput {
+			printJSON(compileResult(compileResp, logData, start))
+		}
+		return
+	}
+
+	if !local {
+		if err := downloadPDF(host, compileResp.PDFURL, pdfPath, false); err != nil {
+			fail(exitCode(err), "Error downloading PDF: %v", err)
+			return
+		}
+	}
+	fmt.Fprintf(console, "[%s] ✓ Built %s in %s%s\n", stamp, pdfPath, elapsed, report)
+	if jsonOutput {
+		result := compileResult(compileResp, logData, start)
+		result.PDF = pdfPath
+		printJSON(result)
+	}
+}
+
+var (
+	// LaTeX warnings: "LaTeX Warning: ...", "Package hyperref Warning: ...", "LaTeX Font Warning: ..."
+	warningRe = regexp.MustCompile(`^(?:LaTeX|Package (\S+)|Class (\S+))(?: \S+)? Warning: (.*)$`)
+	// Errors in -file-line-error style: "./chapter2.tex:42: Undefined control sequence."
+	fileLineErrorRe = regexp.MustCompile(`^(\S+?\.[A-Za-z]+):(\d+): (.+)$`)
+	// The input line TeX shows after an error: "l.42 \foo"
+	errorLineRe = regexp.MustCompile(`^l\.(\d+)(?: (.*))?$`)
+	inputLineRe = regexp.MustCompile(`\s*on input line (\d+)\.?`)
+	// Server log line preceding the output of each LaTeX pass
+	passOutputRe = regexp.MustCompile(`^\[[^\]]*\] Pass \d+ output:`)
+	// Lines the server writes itself
+	serverLogRe = regexp.MustCompile(`^\[\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}\] `)
+)
+
+// An error or warning from a compile log, located in the project when TeX says where
+type diagnostic struct {
+	warning bool
+	file    string // Project-relative path, "" if unknown
+	line    int    // 0 if unknown
+	message string
+}
+
+// Diagnostics found in a compile log
+type logReport struct {
+	diagnostics []diagnostic
+	badBoxes    int
+}
+
+// parseLog extracts errors and warnings from a server compile log. The file
+// each message belongs to is tracked through the "(./file.tex" ... ")" nesting
+// TeX prints as it opens and closes files. Only the last LaTeX pass counts, as
+// earlier passes repeat warnings that later resolve.
+func parseLog(text string) logReport {
+	var report logReport
+	var files []string // Stack of open files; "" for parentheses that aren't files
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if passOutputRe.MatchString(line) {
+			report = logReport{}
+			files = nil
+			continue
+		}
+		if serverLogRe.MatchString(line) {
+			continue
+		}
+
+		current := ""
+		for j := len(files) - 1; j >= 0; j-- {
+			if files[j] != "" {
+				current = files[j]
+				break
+			}
+		}
+
+		switch {
+		case strings.HasPrefix(line, "!  ==> "):
+			// "Fatal error occurred" trailer of -halt-on-error
+			continue
+
+		case strings.HasPrefix(line, "! "):
+			d := diagnostic{file: current, message: strings.TrimSuffix(strings.TrimPrefix(line, "! "), ".")}
+			d.line = errorContext(&d, lines[i+1:])
+			report.diagnostics = append(report.diagnostics, d)
+			continue
+
+		case fileLineErrorRe.MatchString(line):
+			m := fileLineErrorRe.FindStringSubmatch(line)
+			if strings.HasPrefix(strings.TrimSpace(m[3]), "==> ") {
+				continue
+			}
+			d := diagnostic{file: cleanLogPath(m[1]), message: strings.TrimSuffix(m[3], ".")}
+			d.line, _ = strconv.Atoi(m[2])
+			if n := errorContext(&d, lines[i+1:]); d.line == 0 {
+				d.line = n
+			}
+			report.diagnostics = append(report.diagnostics, d)
+			continue
+
+		case warningRe.MatchString(line):
+			m := warningRe.FindStringSubmatch(line)
+			message, pkg, last := m[3], m[1]+m[2], line
+		continuation:
+			for i+1 < len(lines) {
+				next := lines[i+1]
+				switch {
+				case len(last) == maxPrintLine:
+					message += next
+				case pkg != "" && strings.HasPrefix(next, "("+pkg+")"):
+					// Package warnings continue on lines starting with "(package)"
+					message += " " + strings.TrimSpace(strings.TrimPrefix(next, "("+pkg+")"))
+				case pkg == "" && next != "" && !strings.HasSuffix(message, ".") && !strings.ContainsAny(next[:1], "([!"):
+					message += " " + strings.TrimSpace(next)
+				default:
+					break continuation
+				}
+				i++
+				last = next
+			}
+			d := diagnostic{warning: true, file: current}
+			if lm := inputLineRe.FindStringSubmatch(message); lm != nil {
+				d.line, _ = strconv.Atoi(lm[1])
+				message = inputLineRe.ReplaceAllString(message, "")
+			}
+			d.message = strings.TrimSuffix(strings.TrimSpace(message), ".")
+			report.diagnostics = append(report.diagnostics, d)
+			continue
+
+		case strings.HasPrefix(line, "Overfull \\") || strings.HasPrefix(line, "Underfull \\"):
+			report.badBoxes++
+		}
+
+		files = trackFiles(files, line)
+	}
+	return report
+}
+
+// Looks for the "l.42 \foo" line TeX prints after an error among the lines that
+// follow it, returning its line number and naming the culprit of an undefined
+// control sequence in d's message
+func errorContext(d *diagnostic, following []string) int {
+	for _, next := range following[:min(11, len(following))] {
+		if m := errorLineRe.FindStringSubmatch(next); m != nil {
+			// The culprit is the last thing TeX read before stopping
+			if fields := strings.Fields(m[2]); d.message == "Undefined control sequence" && len(fields) > 0 {
+				d.message += " " + fields[len(fields)-1]
+			}
+			line, _ := strconv.Atoi(m[1])
+			return line
+		}
+	}
+	return 0
+}
+
+// Updates the stack of open files with the parentheses on a log line
+func trackFiles(files []string, line string) []string {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '(':
+			name := line[i+1:]
+			if end := strings.IndexAny(name, " ()"); end >= 0 {
+				name = name[:end]
+			}
+			if strings.Contains(name, ".") && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "/") || path.Ext(name) != "") {
+				files = append(files, cleanLogPath(name))
+			} else {
+				files = append(files, "")
+			}
+		case ')':
+			if len(files) > 0 {
+				files = files[:len(files)-1]
+			}
+		}
+	}
+	return files
+}
+
+// Turns a path from the log into a project-relative one
+func cleanLogPath(name string) string {
+	return path.Clean(strings.TrimPrefix(name, "./"))
+}
+
+func (r logReport) count(warning bool) int {
+	n := 0
+	for _, d := range r.diagnostics {
+		if d.warning == warning {
+			n++
+		}
+	}
+	return n
+}
+
+// Formats the counts as " — 2 errors, 3 warnings", or "" when the log is clean
+func (r logReport) String() string {
+	var parts []string
+	if n := r.count(false); n > 0 {
+		parts = append(parts, plural(n, "error"))
+	}
+	if n := r.count(true); n > 0 {
+		parts = append(parts, plural(n, "warning"))
+	}
+	if r.badBoxes > 0 {
+		parts = append(parts, plural(r.badBoxes, "bad box", "bad boxes"))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " — " + strings.Join(parts, ", ")
+}
+
+// printDiagnostics lists errors, then warnings, compiler-style as
+// "file:line: message", at most limit of each. With context, errors are
+// followed by the surrounding lines of the local source, found under sourceDir.
+func printDiagnostics(report logReport, sourceDir string, limit int, context bool) {
+	sources := make(map[string][]string)
+	for _, warning := range []bool{false, true} {
+		shown := 0
+		for _, d := range report.diagnostics {
+			if d.warning != warning {
+				continue
+			}
+			if shown == limit {
+				fmt.Fprintf(console, "... and %d more\n", report.count(warning)-shown)
+				break
+			}
+			shown++
+
+			location := d.file
+			localPath := ""
+			if d.file != "" && !path.IsAbs(d.file) {
+				localPath = filepath.Join(sourceDir, filepath.FromSlash(d.file))
+				location = localPath
+			}
+			if d.line > 0 {
+				location += ":" + strconv.Itoa(d.line)
+			}
+			if location != "" {
+				location = colorize(ansiBold, location+":") + " "
+			}
+			if warning {
+				fmt.Fprintf(console, "%s%s %s\n", location, colorize(ansiYellow, "warning:"), d.message)
+				continue
+			}
+			fmt.Fprintf(console, "%s%s\n", location, colorize(ansiRed, d.message))
+
+			if context && localPath != "" && d.line > 0 {
+				if _, ok := sources[localPath]; !ok {
+					content, _ := ioutil.ReadFile(localPath)
+					sources[localPath] = strings.Split(string(content), "\n")
+				}
+				printSourceContext(sources[localPath], d.line)
+			}
+		}
+	}
+}
+
+// Prints the lines around line (1-based), marking it
+func printSourceContext(lines []string, line int) {
+	if line > len(lines) {
+		return
+	}
+	for n := max(1, line-sourceContextLines); n <= min(len(lines), line+1); n++ {
+		gutter := fmt.Sprintf("  %5d | ", n)
+		if n == line {
+			gutter = colorize(ansiRed, fmt.Sprintf("> %5d | ", n))
+		} else {
+			gutter = colorize(ansiDim, gutter)
+		}
+		fmt.Fprintln(console, gutter+strings.TrimRight(lines[n-1], "\r"))
+	}
+}
+
+const (
+	ansiBold   = "1"
+	ansiDim    = "2"
+	ansiRed    = "31"
+	ansiYellow = "33"
+)
+
+// Colors are used only on a terminal, and never with NO_COLOR set
+var useColor = isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == ""
+
+func colorize(style, text string) string {
+	if !useColor {
+		return text
+	}
+	return "\x1b[" + style + "m" + text + "\x1b[0m"
+}
+
+func plural(n int, word string, pluralForm ...string) string {
+	if n == 1 {
+		return "1 " + word
+	}
+	if len(pluralForm) > 0 {
+		return fmt.Sprintf("%d %s", n, pluralForm[0])
 	}
-	bar.Finish()
-	fmt.Printf("Successfully compiled and saved %s\n", fileName)
+	return fmt.Sprintf("%d %ss", n, word)
 }
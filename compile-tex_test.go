@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Server log of a nested project compiled with pdflatex -file-line-error, whose
+// first pass reports a warning that the last pass no longer has
+const nestedProjectLog = `[2026-10-18 09:12:01] Starting compilation - Compiler: pdflatex, Main: main, Draft: false
+[2026-10-18 09:12:01] Extracting ZIP file
+[2026-10-18 09:12:01] Starting LaTeX compilation (Pass 1)
+[2026-10-18 09:12:02] Pass 1 output:
+This is pdfTeX, Version 3.141592653-2.6-1.40.26 (TeX Live 2024) (preloaded format=pdflatex)
+ restricted \write18 enabled.
+entering extended mode
+(./main.tex
+LaTeX2e <2023-11-01> patch level 1
+L3 programming layer <2024-02-20>
+(/usr/local/texlive/2024/texmf-dist/tex/latex/base/article.cls
+Document Class: article 2023/05/17 v1.4n Standard LaTeX document class
+(/usr/local/texlive/2024/texmf-dist/tex/latex/base/size10.clo))
+(/usr/local/texlive/2024/texmf-dist/tex/latex/l3backend/l3backend-pdftex.def)
+No file main.aux.
+
+LaTeX Warning: Citation ` + "`knuth84'" + ` on page 1 undefined on input line 8.
+
+[1{/usr/local/texlive/2024/texmf-dist/fonts/map/pdftex/updmap/pdftex.map}]
+(./main.aux) )
+Output written on main.pdf (1 page, 24817 bytes).
+Transcript written on main.log.
+
+[2026-10-18 09:12:02] Starting LaTeX compilation (Pass 2)
+[2026-10-18 09:12:03] Pass 2 output:
+This is pdfTeX, Version 3.141592653-2.6-1.40.26 (TeX Live 2024) (preloaded format=pdflatex)
+ restricted \write18 enabled.
+entering extended mode
+(./main.tex
+LaTeX2e <2023-11-01> patch level 1
+L3 programming layer <2024-02-20>
+(/usr/local/texlive/2024/texmf-dist/tex/latex/base/article.cls
+Document Class: article 2023/05/17 v1.4n Standard LaTeX document class
+(/usr/local/texlive/2024/texmf-dist/tex/latex/base/size10.clo))
+(/usr/local/texlive/2024/texmf-dist/tex/latex/l3backend/l3backend-pdftex.def)
+(./main.aux) (./chapters/intro.tex
+
+LaTeX Warning: Reference ` + "`sec:results'" + ` on page 1 undefined on input line 5.
+
+) (./chapters/methods.tex
+Overfull \hbox (12.3456pt too wide) in paragraph at lines 3--4
+[]\OT1/cmr/m/n/10 A line that does not fit the text width of the page at all
+
+[1{/usr/local/texlive/2024/texmf-dist/fonts/map/pdftex/updmap/pdftex.map}]
+./chapters/methods.tex:9: Undefined control sequence.
+l.9 The value is \result
+                        .
+./main.tex:14: LaTeX Error: Environment itemiz undefined.
+
+See the LaTeX manual or LaTeX Companion for explanation.
+Type  H <return>  for immediate help.
+ ...
+
+l.14 \begin{itemiz}
+
+!  ==> Fatal error occurred, no output PDF file produced!
+Transcript written on main.log.
+
+[2026-10-18 09:12:03] LaTeX pass 2 failed: exit status 1
+`
+
+func TestParseLogNestedProject(t *testing.T) {
+	report := parseLog(nestedProjectLog)
+
+	want := []diagnostic{
+		{warning: true, file: "chapters/intro.tex", line: 5, message: "Reference `sec:results' on page 1 undefined"},
+		{file: "chapters/methods.tex", line: 9, message: "Undefined control sequence \\result"},
+		{file: "main.tex", line: 14, message: "LaTeX Error: Environment itemiz undefined"},
+	}
+	if !reflect.DeepEqual(report.diagnostics, want) {
+		t.Errorf("diagnostics:\n got %+v\nwant %+v", report.diagnostics, want)
+	}
+	if report.badBoxes != 1 {
+		t.Errorf("badBoxes = %d, want 1", report.badBoxes)
+	}
+}
+
+func TestParseLogErrorWithoutFileLineStyle(t *testing.T) {
+	log := "[2026-10-18 09:12:01] Pass 1 output:\n" +
+		"(./main.tex (./chapters/intro.tex\n" +
+		"! Undefined control sequence.\n" +
+		"l.3 \\foo\n" +
+		"         \n" +
+		"!  ==> Fatal error occurred, no output PDF file produced!\n"
+	report := parseLog(log)
+
+	want := []diagnostic{{file: "chapters/intro.tex", line: 3, message: "Undefined control sequence \\foo"}}
+	if !reflect.DeepEqual(report.diagnostics, want) {
+		t.Errorf("diagnostics:\n got %+v\nwant %+v", report.diagnostics, want)
+	}
+}
+
+func TestResolveMainFileAddsExtension(t *testing.T) {
+	for given, want := range map[string]string{
+		"thesis":            "thesis.tex",
+		"thesis.tex":        "thesis.tex",
+		"chapters/appendix": "chapters/appendix.tex",
+	} {
+		got, err := resolveMainFile(t.TempDir(), given)
+		if err != nil || got != want {
+			t.Errorf("resolveMainFile(%q) = %q, %v; want %q", given, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+
+	"tex-compiler/pipeline"
+)
+
+// How a compliance profile is produced and checked
+type profileSpec struct {
+	label    string // e.g. PDF/A-2b
+	metadata string // \DocumentMetadata keys
+	flavour  string // veraPDF validation flavour
+	pdfaPart string // PDF/A part, for PDF/A profiles
+	uaPart   string // PDF/UA part, for PDF/UA profiles
+}
+
+var profileSpecs = map[string]*profileSpec{
+	"pdfa-1b": {label: "PDF/A-1b", metadata: "pdfstandard=A-1b, pdfversion=1.4", flavour: "1b", pdfaPart: "1"},
+	"pdfa-2b": {label: "PDF/A-2b", metadata: "pdfstandard=A-2b", flavour: "2b", pdfaPart: "2"},
+	"pdfa-3u": {label: "PDF/A-3u", metadata: "pdfstandard=A-3u", flavour: "3u", pdfaPart: "3"},
+	"pdfua":   {label: "PDF/UA-1", metadata: "pdfstandard=UA-1, testphase=phase-III", flavour: "ua1", uaPart: "1"},
+}
+
+var (
+	langRe = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{1,8}){0,3}$`)
+
+	// Documents that set up PDF/A or tagging themselves
+	ownMetadataRe = regexp.MustCompile(`\\DocumentMetadata\b|\\usepackage\s*(\[[^\]]*\])?\s*\{[^}]*\bpdfx\b`)
+)
+
+// Whether the TeX installation has the colorprofiles package, looked up once
+var colorProfiles struct {
+	once  sync.Once
+	found bool
+}
+
+func colorProfilesInstalled() bool {
+	colorProfiles.once.Do(func() {
+		output, err := exec.Command("kpsewhich", "sRGB.icc").Output()
+		colorProfiles.found = err == nil && len(bytes.TrimSpace(output)) > 0
+	})
+	return colorProfiles.found
+}
+
+// newComplianceProfile checks the 'profile' and 'lang' form fields against the
+// documents and the tools on this server. Returns nil without a profile.
+func newComplianceProfile(name, lang string, documents []*Document, texSources map[string][]byte) (*ComplianceProfile, error) {
+	if name == "" {
+		return nil, nil
+	}
+	spec, ok := profileSpecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q (use pdfa-1b, pdfa-2b, pdfa-3u or pdfua)", name)
+	}
+	if lang == "" && spec.uaPart != "" {
+		lang = "en"
+	}
+	if lang != "" && !langRe.MatchString(lang) {
+		return nil, fmt.Errorf("lang %q is not a language tag such as en or de-CH", lang)
+	}
+
+	profile := &ComplianceProfile{Name: name, spec: spec, ownMetadata: make(map[string]bool)}
+	profile.Preamble = fmt.Sprintf("\\DocumentMetadata{%s}", spec.metadata)
+	if lang != "" {
+		profile.Preamble = fmt.Sprintf("\\DocumentMetadata{%s, lang=%s}", spec.metadata, lang)
+	}
+	for _, doc := range documents {
+		source := pipeline.StripTeXComments(string(texSources[doc.MainFile+".tex"]))
+		if ownMetadataRe.MatchString(source) {
+			profile.ownMetadata[doc.MainFile] = true
+		} else if doc.Engine.JobnameArg == "" {
+			return nil, fmt.Errorf("%s can't have document metadata injected; declare \\DocumentMetadata in %s.tex instead", doc.Engine.Name, doc.MainFile)
+		}
+	}
+
+	if spec.pdfaPart != "" && !colorProfilesInstalled() {
+		return nil, &missingToolError{tool: "the colorprofiles package (sRGB.icc)"}
+	}
+	// Only a full validation can tell that a PDF complies, so there is no fallback
+	if _, err := exec.LookPath("verapdf"); err != nil {
+		return nil, &missingToolError{tool: "verapdf"}
+	}
+	return profile, nil
+}
+
+// The \DocumentMetadata to inject for the main file, or "" if it declares its own
+func (p *ComplianceProfile) preambleFor(mainFile string) string {
+	if p == nil || p.ownMetadata[mainFile] {
+		return ""
+	}
+	return p.Preamble
+}
+
+// checkCompliance validates the PDF against the job's profile, if it has one.
+// Returns the report and, if the PDF must not be delivered, why.
+func checkCompliance(ctx context.Context, job *CompileJob, pdfPath string, logWriter func(string)) (*ComplianceReport, string) {
+	if job.Profile == nil {
+		return nil, ""
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ComplianceTimeout)
+	defer cancel()
+	logWriter(fmt.Sprintf("Validating %s with veraPDF", job.Profile.spec.label))
+	report, err := validateCompliance(ctx, job.Profile.spec, pdfPath)
+	if err != nil {
+		logWriter(fmt.Sprintf("Compliance validation failed: %v", err))
+		return nil, fmt.Sprintf("Compliance validation failed: %v", err)
+	}
+	report.Profile = job.Profile.Name
+
+	if !report.Compliant {
+		for _, issue := range report.Issues {
+			logWriter(fmt.Sprintf("%s: %s", issue.Rule, issue.Message))
+		}
+		return report, fmt.Sprintf("PDF does not comply with %s", job.Profile.spec.label)
+	}
+	logWriter(fmt.Sprintf("PDF complies with %s (checked by %s)", job.Profile.spec.label, report.Validator))
+	return report, ""
+}
+
+// validateCompliance checks the PDF against the profile with veraPDF
+func validateCompliance(ctx context.Context, spec *profileSpec, pdfPath string) (*ComplianceReport, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "verapdf", "--format", "json", "--flavour", spec.flavour, pdfPath)
+	cmd.Stderr = &stderr
+	// veraPDF exits non-zero for non-compliant files, so the report decides
+	output, runErr := cmd.Output()
+
+	var document struct {
+		Report struct {
+			Jobs []struct {
+				ValidationResult json.RawMessage `json:"validationResult"`
+			} `json:"jobs"`
+		} `json:"report"`
+	}
+	if err := json.Unmarshal(output, &document); err != nil || len(document.Report.Jobs) == 0 {
+		if runErr != nil {
+			return nil, fmt.Errorf("verapdf failed: %v: %s", runErr, strings.TrimSpace(stderr.String()))
+		}
+		return nil, fmt.Errorf("unexpected verapdf output")
+	}
+
+	type veraResult struct {
+		Compliant bool `json:"compliant"`
+		Details   struct {
+			RuleSummaries []struct {
+				Specification string `json:"specification"`
+				Clause        string `json:"clause"`
+				TestNumber    int    `json:"testNumber"`
+				Description   string `json:"description"`
+				FailedChecks  int    `json:"failedChecks"`
+			} `json:"ruleSummaries"`
+		} `json:"details"`
+	}
+	// Newer veraPDF versions report a list with one result per flavour
+	raw := document.Report.Jobs[0].ValidationResult
+	var results []veraResult
+	if err := json.Unmarshal(raw, &results); err != nil {
+		var result veraResult
+		if err := json.Unmarshal(raw, &result); err != nil {
+			return nil, fmt.Errorf("unexpected verapdf validation result")
+		}
+		results = []veraResult{result}
+	}
+
+	report := &ComplianceReport{Validator: "verapdf", Compliant: len(results) > 0}
+	for _, result := range results {
+		report.Compliant = report.Compliant && result.Compliant
+		for _, rule := range result.Details.RuleSummaries {
+			if rule.FailedChecks == 0 {
+				continue
+			}
+			report.Issues = append(report.Issues, ComplianceIssue{
+				Rule:         fmt.Sprintf("%s %s-%d", rule.Specification, rule.Clause, rule.TestNumber),
+				Message:      rule.Description,
+				FailedChecks: rule.FailedChecks,
+			})
+		}
+	}
+	return report, nil
+}
@@ -1,17 +1,50 @@
 package main
 
-import "time"
+import (
+	"time"
+
+	"tex-compiler/pipeline"
+)
 
 // Constants
 const (
 	CompilationTimeout = 15 * time.Second
+	DraftTimeout       = 5 * time.Second
 	MaxConcurrentJobs  = 5
 	WorkDir            = "/app/processing"
 	OutputDir          = "/app/output"
 	LogsDir            = "/app/output/logs"
 	FilesDir           = "/app/output/files"
+	WorkspacesDir      = "/app/workspaces"
 	CleanupDelay       = 1 * time.Minute
+	EnginesConfig      = "/app/engines.json"
+	TemplatesDir       = "/app/templates"
+	TemplateManifest   = "template.json"
+	MaxTemplateData    = 1 << 20 // Largest render request body
+	WorkspaceIdleTTL   = 30 * time.Minute
+	MaxWorkspaces      = 50
+	MaxUploadSize      = 32 << 20
+	MaxArchiveSize     = 512 << 20 // Largest /compile upload, streamed to disk
+	MaxFormFieldSize   = 1 << 20
+	MaxDataFieldSize   = 8 << 20 // Largest mail-merge dataset
+	MaxMergeRows       = 500
+	LatexdiffTimeout   = 30 * time.Second
+	PostProcessTimeout = 30 * time.Second // Per PDF, on top of the compilation timeout
+	MaxPDFSteps        = 10
+	MaxAttachments     = 10
+	ComplianceTimeout  = 60 * time.Second // Per PDF, for veraPDF
+	TexcountTimeout    = 15 * time.Second
+	LintTimeout        = 30 * time.Second
+	CallbackAttempts   = 5
+	CallbackBackoff    = 1 * time.Second // Doubled after every failed attempt
+	CallbackTimeout    = 10 * time.Second
+	MaxBatchDocuments  = 10
+	BatchParallelism   = 3
+	MaxMacros          = 50
+	MaxMacroValueBytes = 1024
+	DefaultCompiler    = pipeline.DefaultEngine
+	AutoCompiler       = "auto" // Pick the engine from magic comments and packages
 )
 
 // CUID2-like ID generator
-const alphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
\ No newline at end of file
+const alphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Compares the 'old' and 'new' uploads with latexdiff and compiles the
+// change-marked document. Both are ZIP archives or single .tex files; 'main',
+// 'compiler' and the other /compile fields apply to both versions.
+func handleDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := exec.LookPath("latexdiff"); err != nil {
+		http.Error(w, "latexdiff is not installed on this server", http.StatusNotImplemented)
+		return
+	}
+
+	if rejectIfOverloaded(w) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxArchiveSize)
+	uploads, err := receiveUploads(r, []string{"old", "new"})
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, fmt.Sprintf("Upload exceeds %d MB", MaxArchiveSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	// The archives are handed to the job, which removes them; anything else goes now
+	var job *CompileJob
+	defer func() {
+		for _, upload := range uploads {
+			if job == nil || !job.ownsUpload(upload.Path) {
+				os.Remove(upload.Path)
+			}
+		}
+	}()
+
+	oldUpload, newUpload := firstUpload(uploads, "old"), firstUpload(uploads, "new")
+	if oldUpload.Path == "" || newUpload.Path == "" {
+		http.Error(w, "Upload both the old and the new version", http.StatusBadRequest)
+		return
+	}
+
+	oldProject := readUploadedProject(w, r, oldUpload.Path, oldUpload.Name)
+	if oldProject == nil {
+		return
+	}
+	newProject := readUploadedProject(w, r, newUpload.Path, newUpload.Name)
+	if newProject == nil {
+		return
+	}
+	if len(oldProject.MainFiles) > 1 || len(newProject.MainFiles) > 1 {
+		http.Error(w, "A diff compares a single main file", http.StatusBadRequest)
+		return
+	}
+
+	job = newCompileJob(w, r, newProject.MainFiles, newProject.TexSources)
+	if job == nil {
+		return
+	}
+	job.Diff = &DiffJob{
+		Old:     oldProject,
+		Flatten: len(oldProject.TexSources) > 1 || len(newProject.TexSources) > 1,
+	}
+	if !oldProject.IsSingleFile {
+		job.Diff.OldZipPath = oldUpload.Path
+	}
+	newProject.attach(job, newUpload.Path)
+	job.Timeout += LatexdiffTimeout
+
+	runCompileJob(w, job, nil)
+}
+
+// compileDiff writes the old version next to the job's project, runs latexdiff on
+// the two main files and compiles the result in the new version's tree, where its
+// figures and bibliography resolve. The diff .tex is kept as FilesDir/<job ID>-diff.tex.
+func compileDiff(ctx context.Context, job *CompileJob, projectDir string, logWriter func(string)) *CompileResult {
+	diff := job.Diff
+
+	failed := func(message string) *CompileResult {
+		return &CompileResult{
+			Success: false,
+			Message: message,
+			LogsURL: "/logs/" + job.ID + ".log",
+			JobID:   job.ID,
+		}
+	}
+
+	oldDir := filepath.Join(WorkDir, job.ID+"-old")
+	defer os.RemoveAll(oldDir)
+	if err := os.MkdirAll(oldDir, 0755); err != nil {
+		logWriter(fmt.Sprintf("Failed to create work directory: %v", err))
+		return failed("Failed to create work directory")
+	}
+
+	oldProjectDir := oldDir
+	if diff.Old.IsSingleFile {
+		logWriter("Writing the old version")
+		if err := os.WriteFile(filepath.Join(oldDir, diff.Old.MainFiles[0]+".tex"), diff.Old.TexContent, 0644); err != nil {
+			logWriter(fmt.Sprintf("Failed to write .tex file: %v", err))
+			return failed("Failed to create .tex file")
+		}
+	} else {
+		logWriter("Extracting the old version")
+		if err := extractUpload(diff.OldZipPath, oldDir); err != nil {
+			logWriter(fmt.Sprintf("Failed to extract ZIP: %v", err))
+			return failed("Failed to extract ZIP file")
+		}
+		oldProjectDir = filepath.Join(oldDir, diff.Old.RootDir)
+	}
+
+	args := []string{}
+	if diff.Flatten {
+		args = append(args, "--flatten")
+	}
+	args = append(args,
+		filepath.Join(oldProjectDir, diff.Old.MainFiles[0]+".tex"),
+		filepath.Join(projectDir, job.MainFile+".tex"))
+
+	logWriter(fmt.Sprintf("Running latexdiff %s", strings.Join(args, " ")))
+	diffCtx, cancel := context.WithTimeout(ctx, LatexdiffTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(diffCtx, "latexdiff", args...)
+	cmd.Dir = projectDir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if stderr.Len() > 0 {
+		logWriter(fmt.Sprintf("latexdiff output:\n%s", stderr.String()))
+	}
+	if err != nil {
+		if diffCtx.Err() == context.DeadlineExceeded {
+			logWriter("latexdiff timed out")
+			return failed("latexdiff timed out")
+		}
+		logWriter(fmt.Sprintf("latexdiff failed: %v", err))
+		return failed("latexdiff failed")
+	}
+
+	// The diff document sits next to the new main file so relative paths still work
+	diffMain := job.MainFile + "-diff"
+	if err := os.WriteFile(filepath.Join(projectDir, diffMain+".tex"), stdout.Bytes(), 0644); err != nil {
+		logWriter(fmt.Sprintf("Failed to write diff document: %v", err))
+		return failed("Failed to write diff document")
+	}
+	if err := os.WriteFile(filepath.Join(FilesDir, job.ID+"-diff.tex"), stdout.Bytes(), 0644); err != nil {
+		logWriter(fmt.Sprintf("Failed to save diff document: %v", err))
+		return failed("Failed to save diff document")
+	}
+
+	// latexdiff keeps the new preamble, and with it any \DocumentMetadata
+	if job.Profile != nil && job.Profile.ownMetadata[job.MainFile] {
+		job.Profile.ownMetadata[diffMain] = true
+	}
+
+	doc := &Document{
+		MainFile:       diffMain,
+		Compiler:       job.Compiler,
+		CompilerReason: job.CompilerReason,
+		Engine:         job.Engine,
+	}
+	result := compileDocument(ctx, job, doc, projectDir, job.ID, logWriter)
+	result.LogsURL = "/logs/" + job.ID + ".log"
+	result.JobID = job.ID
+	result.DiffURL = "/files/" + job.ID + "-diff.tex"
+	return result
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTimedOutDiffLeavesNoFiles(t *testing.T) {
+	for _, dir := range []string{WorkDir, LogsDir, FilesDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Skipf("no %s: %v", dir, err)
+		}
+	}
+
+	// latexdiff prints the new version; the engine notes that it ran, then hangs
+	bin := t.TempDir()
+	started := filepath.Join(bin, "started")
+	writeScript(t, filepath.Join(bin, "latexdiff"), "#!/bin/sh\ncat \"$2\"\n")
+	writeScript(t, filepath.Join(bin, "pdflatex"), "#!/bin/sh\ntouch "+started+"\nexec sleep 30\n")
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	delay := cleanupDelay
+	cleanupDelay = 0
+	t.Cleanup(func() { cleanupDelay = delay })
+
+	engine, _ := engines.Get("pdflatex")
+	source := []byte("\\documentclass{article}\n\\begin{document}\nText\n\\end{document}\n")
+	job := &CompileJob{
+		ID:           generateID(),
+		MainFile:     "main",
+		Compiler:     "pdflatex",
+		Engine:       engine,
+		IsSingleFile: true,
+		TexContent:   source,
+		Diff:         &DiffJob{Old: &uploadedProject{MainFiles: []string{"main"}, TexContent: source, IsSingleFile: true}},
+		Timeout:      time.Second,
+		ResponseChan: make(chan *CompileResult, 1),
+		Done:         make(chan struct{}),
+	}
+
+	if _, status := executeCompileJob(job); status != http.StatusRequestTimeout {
+		t.Fatalf("status %d, want 408", status)
+	}
+	if _, err := os.Stat(started); err != nil {
+		t.Fatal("the diff document was never compiled")
+	}
+
+	pattern := filepath.Join(FilesDir, job.ID+"*")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		leftovers, _ := filepath.Glob(pattern)
+		logs, _ := filepath.Glob(filepath.Join(LogsDir, job.ID+"*"))
+		if len(leftovers)+len(logs) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("left behind after cleanup: %v %v", leftovers, logs)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func writeScript(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
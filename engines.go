@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"tex-compiler/pipeline"
+)
+
+func NewEngineRegistry() *EngineRegistry {
+	reg := &EngineRegistry{
+		engines: make(map[string]*Engine),
+	}
+	for _, engine := range pipeline.DefaultEngines() {
+		reg.Register(engine)
+	}
+	return reg
+}
+
+// Register adds an engine or replaces an existing one with the same name
+func (er *EngineRegistry) Register(engine *Engine) {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	if _, exists := er.engines[engine.Name]; !exists {
+		er.order = append(er.order, engine.Name)
+	}
+	er.engines[engine.Name] = engine
+}
+
+// LoadFile merges engine definitions from a JSON file of the form {"engines": [...]}.
+// A missing file is not an error; the defaults are used as-is.
+func (er *EngineRegistry) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var config struct {
+		Engines []*Engine `json:"engines"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	for _, engine := range config.Engines {
+		if engine.Name == "" || engine.Command == "" {
+			return fmt.Errorf("engine entries in %s need a name and a command", path)
+		}
+		if engine.OutputExt == "" {
+			engine.OutputExt = ".pdf"
+		}
+		if !strings.HasPrefix(engine.OutputExt, ".") {
+			engine.OutputExt = "." + engine.OutputExt
+		}
+		if engine.JobnameArg == "" && !engine.SelfContained {
+			engine.JobnameArg = "-jobname="
+		}
+		if engine.OutputExt != ".pdf" && len(engine.PostProcess) == 0 {
+			return fmt.Errorf("engine %s produces %s and needs a post_process step", engine.Name, engine.OutputExt)
+		}
+		er.Register(engine)
+	}
+	return nil
+}
+
+// Get returns the named engine if it is configured and installed on this host
+func (er *EngineRegistry) Get(name string) (*Engine, bool) {
+	er.mu.RLock()
+	engine, ok := er.engines[name]
+	er.mu.RUnlock()
+	if !ok || !engine.Available() {
+		return nil, false
+	}
+	return engine, true
+}
+
+func (er *EngineRegistry) List() []*Engine {
+	er.mu.RLock()
+	defer er.mu.RUnlock()
+
+	list := make([]*Engine, 0, len(er.order))
+	for _, name := range er.order {
+		list = append(list, er.engines[name])
+	}
+	return list
+}
+
+// AvailableNames returns the names of engines whose commands are installed
+func (er *EngineRegistry) AvailableNames() []string {
+	var names []string
+	for _, engine := range er.List() {
+		if engine.Available() {
+			names = append(names, engine.Name)
+		}
+	}
+	return names
+}
+
+// Resolves the engines config path, allowing an override via TEX_ENGINES_CONFIG
+func enginesConfigPath() string {
+	if path := os.Getenv("TEX_ENGINES_CONFIG"); path != "" {
+		return filepath.Clean(path)
+	}
+	return EnginesConfig
+}
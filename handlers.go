@@ -2,17 +2,24 @@ package main
 
 import (
 	"archive/zip"
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
+
+	"tex-compiler/pipeline"
 )
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -27,6 +34,67 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(status)
 }
 
+// GET /jobs lists the compilations currently running, longest-running first
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tasks := runningJobs.GetRunningTasks()
+	if tasks == nil {
+		tasks = []map[string]interface{}{}
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i]["elapsed_time"].(float64) > tasks[j]["elapsed_time"].(float64)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"running_jobs":   len(tasks),
+		"max_concurrent": MaxConcurrentJobs,
+		"running_tasks":  tasks,
+	})
+}
+
+func handleEngines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var list []map[string]interface{}
+	for _, engine := range engines.List() {
+		list = append(list, map[string]interface{}{
+			"name":         engine.Name,
+			"command":      engine.Command,
+			"args":         engine.Args,
+			"output_ext":   engine.OutputExt,
+			"post_process": engine.PostProcess,
+			"available":    engine.Available(),
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"default": DefaultCompiler,
+		"engines": list,
+	})
+}
+
+// Writes a 503 with the running tasks if the server is at capacity
+func rejectIfOverloaded(w http.ResponseWriter) bool {
+	if runningJobs.Count() < MaxConcurrentJobs {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+
+	response := map[string]interface{}{
+		"error":         "Server overloaded",
+		"message":       fmt.Sprintf("Maximum %d concurrent compilations reached", MaxConcurrentJobs),
+		"running_tasks": runningJobs.GetRunningTasks(),
+	}
+	json.NewEncoder(w).Encode(response)
+	return true
+}
+
 func handleCompile(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -34,165 +102,607 @@ func handleCompile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if we're at capacity
-	if runningJobs.Count() >= MaxConcurrentJobs {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusServiceUnavailable)
-
-		response := map[string]interface{}{
-			"error":         "Server overloaded",
-			"message":       fmt.Sprintf("Maximum %d concurrent compilations reached", MaxConcurrentJobs),
-			"running_tasks": runningJobs.GetRunningTasks(),
-		}
-		json.NewEncoder(w).Encode(response)
+	if rejectIfOverloaded(w) {
 		return
 	}
 
-	// Parse multipart form
-	if err := r.ParseMultipartForm(32 << 20); err != nil { // 32MB max
+	// Stream the upload and any PDF attachments to disk
+	r.Body = http.MaxBytesReader(w, r.Body, MaxArchiveSize)
+	uploads, err := receiveUploads(r, []string{"file", "attachment"})
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, fmt.Sprintf("Upload exceeds %d MB", MaxArchiveSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
 		http.Error(w, "Failed to parse form", http.StatusBadRequest)
 		return
 	}
 
-	// Get file
-	file, header, err := r.FormFile("file")
-	if err != nil {
+	// The archive and attachments are handed to the job, which removes them;
+	// anything else goes now
+	var job *CompileJob
+	defer func() {
+		for _, upload := range uploads {
+			if job == nil || !job.ownsUpload(upload.Path) {
+				os.Remove(upload.Path)
+			}
+		}
+	}()
+
+	upload := firstUpload(uploads, "file")
+	if upload.Path == "" {
 		http.Error(w, "No file uploaded", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
-	// Read file data
-	fileData, err := io.ReadAll(file)
+	postProcess, err := parsePostProcess(r.FormValue("postprocess"), uploads)
 	if err != nil {
-		http.Error(w, "Failed to read uploaded file", http.StatusInternalServerError)
+		respondPostProcessError(w, err)
 		return
 	}
 
-	// Determine file type and handle accordingly
-	var zipData, texContent []byte
-	var mainFile string
-	var isSingleFile bool
+	project := readUploadedProject(w, r, upload.Path, upload.Name)
+	if project == nil {
+		return
+	}
 
-	filename := strings.ToLower(header.Filename)
-	if strings.HasSuffix(filename, ".zip") {
-		// ZIP file handling
-		zipData = fileData
-		isSingleFile = false
+	job = newCompileJob(w, r, project.MainFiles, project.TexSources)
+	if job == nil {
+		return
+	}
+	project.attach(job, upload.Path)
+	if postProcess != nil {
+		job.PostProcess = postProcess
+		documents := len(job.Documents)
+		if documents == 0 {
+			documents = 1
+		}
+		job.Timeout += PostProcessTimeout * time.Duration(documents)
+	}
+
+	runCompileJob(w, job, nil)
+}
+
+// A project uploaded as a ZIP archive or a single .tex file
+type uploadedProject struct {
+	MainFiles    []string
+	TexSources   map[string][]byte
+	TexContent   []byte // For direct .tex file uploads
+	RootDir      string
+	IsSingleFile bool
+}
 
+// Reads the uploaded ZIP archive or .tex file and picks its main files. On invalid
+// input it writes an error response and returns nil.
+func readUploadedProject(w http.ResponseWriter, r *http.Request, uploadPath, uploadName string) *uploadedProject {
+	project := readProjectSources(w, uploadPath, uploadName)
+	if project == nil || project.IsSingleFile {
+		return project
+	}
+	mainFiles, ok := mainFilesFromRequest(w, r, project.TexSources, project.RootDir)
+	if !ok {
+		return nil
+	}
+	project.MainFiles = mainFiles
+	return project
+}
+
+// Reads the .tex sources of the uploaded ZIP archive or .tex file. Only a single
+// .tex file has its main file set. On invalid input it writes an error response
+// and returns nil.
+func readProjectSources(w http.ResponseWriter, uploadPath, uploadName string) *uploadedProject {
+	filename := strings.ToLower(uploadName)
+	if strings.HasSuffix(filename, ".zip") {
 		// Analyze the zip file to determine the main .tex file
-		zipReader, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+		zipReader, err := zip.OpenReader(uploadPath)
 		if err != nil {
 			http.Error(w, "Failed to read zip file", http.StatusInternalServerError)
-			return
+			return nil
 		}
+		defer zipReader.Close()
 
-		var texFiles []string
-		for _, f := range zipReader.File {
-			if !f.FileInfo().IsDir() && strings.HasSuffix(strings.ToLower(f.Name), ".tex") {
-				texFiles = append(texFiles, f.Name)
-			}
+		texSources, err := readZipTexFiles(&zipReader.Reader)
+		if err != nil {
+			http.Error(w, "Failed to read zip file", http.StatusInternalServerError)
+			return nil
 		}
 
-		if len(texFiles) == 0 {
+		// Treat a single wrapping directory (e.g. Overleaf exports) as the project root
+		rootDir := archiveRoot(&zipReader.Reader)
+		texSources = relativeToRoot(texSources, rootDir)
+
+		if len(texSources) == 0 {
 			http.Error(w, "No .tex files found in the ZIP archive", http.StatusBadRequest)
-			return
+			return nil
 		}
 
-		if len(texFiles) == 1 {
-			// If there's only one .tex file, use it as the main file.
-			mainFile = strings.TrimSuffix(texFiles[0], ".tex")
-		} else {
-			// If multiple .tex files, check 'main' parameter, then fallback to 'main.tex'.
-			mainFileInput := r.FormValue("main")
-			if mainFileInput == "" {
-				http.Error(w, "The 'main' parameter is required for ZIP files with multiple .tex files (e.g., 'main', 'document').", http.StatusBadRequest)
-				return
+		return &uploadedProject{TexSources: texSources, RootDir: rootDir}
+	}
+
+	if strings.HasSuffix(filename, ".tex") {
+		texContent, err := os.ReadFile(uploadPath)
+		if err != nil {
+			http.Error(w, "Failed to read uploaded file", http.StatusInternalServerError)
+			return nil
+		}
+		return &uploadedProject{
+			MainFiles:    []string{strings.TrimSuffix(uploadName, ".tex")},
+			TexSources:   map[string][]byte{uploadName: texContent},
+			TexContent:   texContent,
+			IsSingleFile: true,
+		}
+	}
+
+	http.Error(w, "Only ZIP and .tex files are allowed", http.StatusBadRequest)
+	return nil
+}
+
+// Points the job at the project. The job takes over an uploaded archive and
+// removes it once it has run.
+func (p *uploadedProject) attach(job *CompileJob, uploadPath string) {
+	if !p.IsSingleFile {
+		job.ZipPath = uploadPath
+	}
+	job.TexContent = p.TexContent
+	job.RootDir = p.RootDir
+	job.IsSingleFile = p.IsSingleFile
+}
+
+// Writes the project into dir, for analyses that don't run a job, and returns
+// the directory its main files are relative to
+func (p *uploadedProject) writeTo(dir, uploadPath string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if p.IsSingleFile {
+		return dir, os.WriteFile(filepath.Join(dir, p.MainFiles[0]+".tex"), p.TexContent, 0644)
+	}
+	if err := extractUpload(uploadPath, dir); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, p.RootDir), nil
+}
+
+// receiveUpload reads the multipart request as a stream, writing the 'file' part
+// to a temporary file under WorkDir and collecting the other fields into r.Form,
+// so uploads are never held in memory. Fields may come before or after the file.
+// Parts named in dataFields, files or not, are read into r.Form as well, up to
+// MaxDataFieldSize. Returns the saved file's path and original name, or "" if no
+// file was sent.
+func receiveUpload(r *http.Request, dataFields ...string) (uploadPath, uploadName string, err error) {
+	uploads, err := receiveUploads(r, []string{"file"}, dataFields...)
+	if err != nil || len(uploads) == 0 {
+		return "", "", err
+	}
+	for _, extra := range uploads[1:] {
+		os.Remove(extra.Path)
+	}
+	return uploads[0].Path, uploads[0].Name, nil
+}
+
+// A file part saved under WorkDir
+type savedUpload struct {
+	Field string
+	Path  string
+	Name  string // Original file name
+}
+
+// The first upload of the field, or the zero value if there is none
+func firstUpload(uploads []savedUpload, field string) savedUpload {
+	for _, upload := range uploads {
+		if upload.Field == field {
+			return upload
+		}
+	}
+	return savedUpload{}
+}
+
+// receiveUploads is receiveUpload for requests with several files: every part of
+// fileFields is saved, in request order. On error no file is kept.
+func receiveUploads(r *http.Request, fileFields []string, dataFields ...string) (uploads []savedUpload, err error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			for _, upload := range uploads {
+				os.Remove(upload.Path)
 			}
-			// Ensure the .tex extension is stripped if present
-			mainFile = strings.TrimSuffix(mainFileInput, ".tex")
 		}
+	}()
 
-	} else if strings.HasSuffix(filename, ".tex") {
-		// Single .tex file handling
-		texContent = fileData
-		mainFile = strings.TrimSuffix(header.Filename, ".tex")
-		isSingleFile = true
-	} else {
-		http.Error(w, "Only ZIP and .tex files are allowed", http.StatusBadRequest)
-		return
+	values := make(url.Values)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return uploads, err
+		}
+
+		isData := false
+		for _, name := range dataFields {
+			isData = isData || part.FormName() == name
+		}
+		if part.FileName() == "" || isData {
+			limit := MaxFormFieldSize
+			if isData {
+				limit = MaxDataFieldSize
+			}
+			value, err := io.ReadAll(io.LimitReader(part, int64(limit)+1))
+			if err != nil {
+				return uploads, err
+			}
+			if len(value) > limit {
+				return uploads, fmt.Errorf("form field %s is too large", part.FormName())
+			}
+			values.Add(part.FormName(), string(value))
+			continue
+		}
+
+		isFile := false
+		for _, name := range fileFields {
+			isFile = isFile || part.FormName() == name
+		}
+		if !isFile {
+			continue
+		}
+
+		outFile, err := os.CreateTemp(WorkDir, "upload-*")
+		if err != nil {
+			return uploads, err
+		}
+		uploads = append(uploads, savedUpload{Field: part.FormName(), Path: outFile.Name(), Name: filepath.Base(part.FileName())})
+		_, err = io.Copy(outFile, part)
+		if closeErr := outFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return uploads, err
+		}
+	}
+
+	// Options may also come in the query string; FormValue prefers the body's
+	form := make(url.Values, len(values))
+	for key, list := range values {
+		form[key] = append([]string(nil), list...)
+	}
+	for key, list := range r.URL.Query() {
+		form[key] = append(form[key], list...)
+	}
+	r.Form = form
+	r.PostForm = values
+	r.MultipartForm = &multipart.Form{Value: values}
+	return uploads, nil
+}
+
+// Picks the main files from the 'main' form field, or detects the main file when
+// omitted. 'main' may be repeated or comma-separated to compile several roots,
+// or '*' for every root document. On failure it writes an error response and
+// returns false.
+func mainFilesFromRequest(w http.ResponseWriter, r *http.Request, texSources map[string][]byte, rootDir string) ([]string, bool) {
+	r.FormValue("main") // Parses the form
+	var inputs []string
+	for _, value := range r.Form["main"] {
+		for _, input := range strings.Split(value, ",") {
+			if input = strings.TrimSpace(input); input != "" {
+				inputs = append(inputs, input)
+			}
+		}
+	}
+
+	if len(inputs) == 1 && inputs[0] == "*" {
+		inputs = rootCandidates(texSources)
+		if len(inputs) == 0 {
+			http.Error(w, "No root documents (files with \\documentclass) found", http.StatusBadRequest)
+			return nil, false
+		}
 	}
 
+	if len(inputs) > 0 {
+		var mainFiles []string
+		seen := make(map[string]bool)
+		for _, input := range inputs {
+			// Ensure the .tex extension and any root folder prefix are stripped if present
+			mainFile := strings.TrimSuffix(input, ".tex")
+			if rootDir != "" {
+				mainFile = strings.TrimPrefix(mainFile, rootDir+"/")
+			}
+			if !seen[mainFile] {
+				seen[mainFile] = true
+				mainFiles = append(mainFiles, mainFile)
+			}
+		}
+		if len(mainFiles) > MaxBatchDocuments {
+			http.Error(w, fmt.Sprintf("At most %d documents can be compiled in one request", MaxBatchDocuments), http.StatusBadRequest)
+			return nil, false
+		}
+		return mainFiles, true
+	}
+
+	if len(texSources) == 1 {
+		// If there's only one .tex file, use it as the main file.
+		for name := range texSources {
+			return []string{strings.TrimSuffix(name, ".tex")}, true
+		}
+	}
+
+	// If multiple .tex files, find the root document
+	mainFile, err := detectMainFile(texSources)
+	var mainErr *MainFileError
+	if errors.As(err, &mainErr) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":      "Main file not detected",
+			"message":    mainErr.Message,
+			"candidates": mainErr.Candidates,
+		})
+		return nil, false
+	}
+	return []string{mainFile}, true
+}
+
+// Builds a job from the compiler and mode form fields. On invalid input it writes
+// an error response and returns nil.
+func newCompileJob(w http.ResponseWriter, r *http.Request, mainFiles []string, texSources map[string][]byte) *CompileJob {
 	compiler := r.FormValue("compiler")
 	if compiler == "" {
-		compiler = "pdflatex"
+		compiler = DefaultCompiler
 	}
-	if !isValidCompiler(compiler) {
-		http.Error(w, "Invalid compiler. Use: pdflatex, lualatex, or xelatex", http.StatusBadRequest)
-		return
+
+	// With compiler=auto every document gets its own engine
+	var documents []*Document
+	for _, mainFile := range mainFiles {
+		doc := &Document{MainFile: mainFile, Compiler: compiler}
+		if compiler == AutoCompiler {
+			doc.Compiler, doc.CompilerReason = pipeline.DetectEngine(texSources[mainFile+".tex"], includedSources(mainFile+".tex", texSources))
+			if _, ok := engines.Get(doc.Compiler); !ok {
+				http.Error(w, fmt.Sprintf("Detected compiler %s (%s) for %s is not available on this server", doc.Compiler, doc.CompilerReason, mainFile), http.StatusBadRequest)
+				return nil
+			}
+		}
+		engine, ok := engines.Get(doc.Compiler)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Invalid compiler. Use: %s, or %s", strings.Join(engines.AvailableNames(), ", "), AutoCompiler), http.StatusBadRequest)
+			return nil
+		}
+		doc.Engine = engine
+		documents = append(documents, doc)
 	}
 
-	// Create job
-	jobID := generateID()
-	ctx, cancel := context.WithTimeout(context.Background(), CompilationTimeout)
+	mode := r.FormValue("mode")
+	if mode != "" && mode != "full" && mode != "draft" {
+		http.Error(w, "Invalid mode. Use: full or draft", http.StatusBadRequest)
+		return nil
+	}
+	draft := mode == "draft"
+	timeout := CompilationTimeout
+	if draft {
+		timeout = DraftTimeout
+	}
+
+	jobname := r.FormValue("jobname")
+	if jobname != "" {
+		if !jobnameRe.MatchString(jobname) {
+			http.Error(w, "Invalid jobname. Use up to 64 letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+			return nil
+		}
+		if len(documents) > 1 {
+			http.Error(w, "jobname can't be used when compiling several documents", http.StatusBadRequest)
+			return nil
+		}
+	}
+	macros, err := parseMacros(r.FormValue("macros"))
+	if err == nil {
+		names := make([]string, 0, len(macros))
+		for name := range macros {
+			names = append(names, name)
+		}
+		err = checkPredefinedMacros(names, documents, texSources)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid macros: %v", err), http.StatusBadRequest)
+		return nil
+	}
+	if jobname != "" || len(macros) > 0 {
+		for _, doc := range documents {
+			if doc.Engine.JobnameArg == "" {
+				http.Error(w, fmt.Sprintf("%s does not support jobname or macros", doc.Engine.Name), http.StatusBadRequest)
+				return nil
+			}
+		}
+	}
+
+	profile, err := newComplianceProfile(r.FormValue("profile"), r.FormValue("lang"), documents, texSources)
+	var missingTool *missingToolError
+	if errors.As(err, &missingTool) {
+		http.Error(w, fmt.Sprintf("Invalid profile: %v", err), http.StatusNotImplemented)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid profile: %v", err), http.StatusBadRequest)
+		return nil
+	}
+	if profile != nil {
+		timeout += ComplianceTimeout
+	}
+
+	stats := r.FormValue("stats") == "true"
+	if stats {
+		if _, err := exec.LookPath("texcount"); err != nil {
+			http.Error(w, "stats needs texcount, which is not installed on this server", http.StatusNotImplemented)
+			return nil
+		}
+		timeout += TexcountTimeout
+	}
+
+	var lint *LintOptions
+	if r.FormValue("lint") == "true" {
+		lint, err = parseLintOptions(r.FormValue("lint_ignore"), r.FormValue("lint_lacheck"))
+		if err != nil {
+			respondLintError(w, err)
+			return nil
+		}
+	}
+
+	var callback *CallbackDelivery
+	if callbackURL := r.FormValue("callback_url"); callbackURL != "" {
+		if webhookSecret() == "" {
+			http.Error(w, "Callbacks are not enabled on this server", http.StatusBadRequest)
+			return nil
+		}
+		if err := validateCallbackURL(callbackURL); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid callback_url: %v", err), http.StatusBadRequest)
+			return nil
+		}
+		callback = &CallbackDelivery{URL: callbackURL, Status: "pending"}
+	}
 
 	job := &CompileJob{
-		ID:           jobID,
-		ZipData:      zipData,
-		TexContent:   texContent,
-		MainFile:     mainFile,
-		Compiler:     compiler,
-		IsSingleFile: isSingleFile,
-		StartTime:    time.Now(),
-		ResponseChan: make(chan *CompileResult, 1),
-		Cancel:       cancel,
+		ID:             generateID(),
+		MainFile:       documents[0].MainFile,
+		Compiler:       documents[0].Compiler,
+		CompilerReason: documents[0].CompilerReason,
+		Engine:         documents[0].Engine,
+		Draft:          draft,
+		Jobname:        jobname,
+		Macros:         macros,
+		Profile:        profile,
+		Stats:          stats,
+		Lint:           lint,
+		Timeout:        timeout,
+		Callback:       callback,
+		ResponseChan:   make(chan *CompileResult, 1),
+		Done:           make(chan struct{}),
+	}
+
+	if len(documents) > 1 {
+		job.Documents = documents
+		job.MainFile = strings.Join(mainFiles, ", ")
+		job.Compiler = compiler
+		job.CompilerReason = ""
+		job.Parallel = r.FormValue("parallel") == "true"
+
+		// Each round of concurrently compiled documents gets the full timeout
+		workers := batchWorkers(job)
+		rounds := (len(documents) + workers - 1) / workers
+		job.Timeout = timeout * time.Duration(rounds)
+	}
+	if lint != nil {
+		// The project is linted once, before any document is compiled
+		job.Timeout += LintTimeout
+	}
+	return job
+}
+
+// Runs the job and writes its result as the response. With a callback URL the job
+// runs in the background, the response is 202 Accepted and the result is delivered
+// to the callback instead. release, if set, is called once processJob has returned,
+// which can be after a timed-out request has been answered.
+func runCompileJob(w http.ResponseWriter, job *CompileJob, release func()) {
+	if release != nil {
+		go func() {
+			<-job.Done
+			release()
+		}()
+	}
+
+	if job.Callback != nil {
+		asyncJobs.Add(job)
+		go func() {
+			result, _ := executeCompileJob(job)
+			deliverCallback(job, result)
+		}()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"job_id":     job.ID,
+			"status_url": "/jobs/" + job.ID,
+		})
+		return
 	}
 
+	result, status := executeCompileJob(job)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// Starts the job and waits for it, returning the result and the HTTP status to report
+func executeCompileJob(job *CompileJob) (*CompileResult, int) {
+	jobID := job.ID
+	ctx, cancel := context.WithTimeout(context.Background(), job.Timeout)
+	job.Cancel = cancel
+	job.StartTime = time.Now()
+
 	// Add to running jobs
 	runningJobs.Add(job)
 
 	// Process job in goroutine
 	go processJob(ctx, job)
 
-	log.Printf("📥 [%s] Job started. Compiler: %s, Main: %s, Running jobs: %d",
-		jobID, compiler, mainFile, runningJobs.Count())
+	log.Printf("📥 [%s] Job started. Compiler: %s, Main: %s, Draft: %t, Running jobs: %d",
+		jobID, job.Compiler, job.MainFile, job.Draft, runningJobs.Count())
 
 	// Wait for result
 	select {
 	case result := <-job.ResponseChan:
 		runningJobs.Remove(jobID)
 		cancel()
+		result.Compiler = job.Compiler
+		result.CompilerReason = job.CompilerReason
+		result.Draft = job.Draft
+
+		// Schedule cleanup
+		go scheduleCleanup(jobID)
 
-		w.Header().Set("Content-Type", "application/json")
 		if result.Success {
-			w.WriteHeader(http.StatusOK)
 			log.Printf("✅ [%s] Compilation successful", jobID)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Printf("❌ [%s] Compilation failed: %s", jobID, result.Message)
+			return result, http.StatusOK
 		}
-		json.NewEncoder(w).Encode(result)
-
-		// Schedule cleanup
-		go scheduleCleanup(jobID)
+		log.Printf("❌ [%s] Compilation failed: %s", jobID, result.Message)
+		return result, http.StatusInternalServerError
 
 	case <-ctx.Done():
 		runningJobs.Remove(jobID)
 		cancel()
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusRequestTimeout)
-		result := &CompileResult{
-			Success: false,
-			Message: "Compilation timed out",
-			JobID:   jobID,
-		}
-		json.NewEncoder(w).Encode(result)
+		// Batch PDFs, merge rows and diff documents may already be in FilesDir,
+		// and processJob can still add to them until it returns
+		go func() {
+			<-job.Done
+			scheduleCleanup(jobID)
+		}()
+
 		log.Printf("⏰ [%s] Compilation timed out", jobID)
+		return &CompileResult{
+			Success:        false,
+			Message:        "Compilation timed out",
+			JobID:          jobID,
+			Compiler:       job.Compiler,
+			CompilerReason: job.CompilerReason,
+			Draft:          job.Draft,
+		}, http.StatusRequestTimeout
 	}
 }
 
 func processJob(ctx context.Context, job *CompileJob) {
-	var output string
+	defer close(job.Done)
+	if job.ZipPath != "" {
+		defer os.Remove(job.ZipPath)
+	}
+	if job.Diff != nil && job.Diff.OldZipPath != "" {
+		defer os.Remove(job.Diff.OldZipPath)
+	}
+	if job.PostProcess != nil {
+		defer job.PostProcess.removeAttachments()
+	}
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("🚨 [%s] Panic during compilation: %v", job.ID, r)
@@ -205,10 +715,13 @@ func processJob(ctx context.Context, job *CompileJob) {
 	}()
 
 	tempDir := filepath.Join(WorkDir, job.ID)
-	logFile := filepath.Join(LogsDir, job.ID+".log")
+	if job.Workspace != nil {
+		// Persistent workspaces are compiled in place
+		tempDir = job.Workspace.Dir
+	}
 
 	// Create log file
-	logFileHandle, err := os.Create(logFile)
+	logFile, err := createJobLog(job.ID)
 	if err != nil {
 		job.ResponseChan <- &CompileResult{
 			Success: false,
@@ -217,22 +730,21 @@ func processJob(ctx context.Context, job *CompileJob) {
 		}
 		return
 	}
-	defer logFileHandle.Close()
+	defer logFile.Close()
+	logWriter := logFile.Write
 
-	logWriter := func(message string) {
-		timestamp := time.Now().Format("2006-01-02 15:04:05")
-		logLine := fmt.Sprintf("[%s] %s\n", timestamp, message)
-		logFileHandle.WriteString(logLine)
-		logFileHandle.Sync()
+	logWriter(fmt.Sprintf("Starting compilation - Compiler: %s, Main: %s, Draft: %t", job.Compiler, job.MainFile, job.Draft))
+	if job.CompilerReason != "" {
+		logWriter(fmt.Sprintf("Compiler selected automatically: %s", job.CompilerReason))
 	}
 
-	logWriter(fmt.Sprintf("Starting compilation - Compiler: %s, Main: %s", job.Compiler, job.MainFile))
-
 	// Cleanup temp directory
-	defer func() {
-		logWriter("Cleaning up temporary files")
-		os.RemoveAll(tempDir)
-	}()
+	if job.Workspace == nil {
+		defer func() {
+			logWriter("Cleaning up temporary files")
+			os.RemoveAll(tempDir)
+		}()
+	}
 
 	// Create temp directory
 	if err := os.MkdirAll(tempDir, 0755); err != nil {
@@ -247,11 +759,25 @@ func processJob(ctx context.Context, job *CompileJob) {
 	}
 
 	// Handle file extraction/creation based on job type
-	var texFile string
-	if job.IsSingleFile {
+	projectDir := tempDir
+	if job.Workspace != nil {
+		logWriter(fmt.Sprintf("Using workspace %s", job.Workspace.ID))
+	} else if job.Template != nil {
+		logWriter(fmt.Sprintf("Rendering template %s", job.Template.Template.Name))
+		if err := job.Template.WriteTo(tempDir); err != nil {
+			logWriter(fmt.Sprintf("Failed to write template files: %v", err))
+			job.ResponseChan <- &CompileResult{
+				Success: false,
+				Message: "Failed to write template files",
+				LogsURL: "/logs/" + job.ID + ".log",
+				JobID:   job.ID,
+			}
+			return
+		}
+	} else if job.IsSingleFile {
 		// Handle single .tex file
 		logWriter("Processing single .tex file")
-		texFile = filepath.Join(tempDir, job.MainFile+".tex")
+		texFile := filepath.Join(tempDir, job.MainFile+".tex")
 		if err := os.WriteFile(texFile, job.TexContent, 0644); err != nil {
 			logWriter(fmt.Sprintf("Failed to write .tex file: %v", err))
 			job.ResponseChan <- &CompileResult{
@@ -265,7 +791,7 @@ func processJob(ctx context.Context, job *CompileJob) {
 	} else {
 		// Handle ZIP file
 		logWriter("Extracting ZIP file")
-		if err := extractZip(job.ZipData, tempDir); err != nil {
+		if err := extractUpload(job.ZipPath, tempDir); err != nil {
 			logWriter(fmt.Sprintf("Failed to extract ZIP: %v", err))
 			job.ResponseChan <- &CompileResult{
 				Success: false,
@@ -276,134 +802,219 @@ func processJob(ctx context.Context, job *CompileJob) {
 			return
 		}
 
-		// Find main .tex file
-		texFile = filepath.Join(tempDir, job.MainFile)
-		if !strings.HasSuffix(job.MainFile, ".tex") {
-			texFile += ".tex"
-		}
+		// Compile from inside the archive's wrapping folder, if any
+		projectDir = filepath.Join(tempDir, job.RootDir)
 	}
 
-	if _, err := os.Stat(texFile); os.IsNotExist(err) {
-		logWriter(fmt.Sprintf("Main file not found: %s", job.MainFile))
-		job.ResponseChan <- &CompileResult{
-			Success: false,
-			Message: fmt.Sprintf("Main file not found: %s", job.MainFile),
-			LogsURL: "/logs/" + job.ID + ".log",
-			JobID:   job.ID,
+	// Lint the sources as uploaded, before compiling adds generated files
+	var lint *LintReport
+	if job.Lint != nil {
+		lint = lintOnCompile(ctx, job.Lint, projectDir, logWriter)
+	}
+
+	var result *CompileResult
+	if len(job.Documents) > 0 {
+		result = compileBatch(ctx, job, projectDir, logWriter)
+	} else if job.Merge != nil {
+		result = compileMerge(ctx, job, projectDir, logWriter)
+	} else if job.Diff != nil {
+		result = compileDiff(ctx, job, projectDir, logWriter)
+	} else {
+		doc := &Document{
+			MainFile:       job.MainFile,
+			Compiler:       job.Compiler,
+			CompilerReason: job.CompilerReason,
+			Engine:         job.Engine,
 		}
-		return
+		result = compileDocument(ctx, job, doc, projectDir, job.ID, logWriter)
+		result.LogsURL = "/logs/" + job.ID + ".log"
+		result.JobID = job.ID
 	}
+	result.Lint = lint
+	job.ResponseChan <- result
+}
 
-	// Get base name for output files
-	baseName := strings.TrimSuffix(filepath.Base(texFile), ".tex")
+// Reports whether the uploaded file at path was handed to the job, which removes it
+// once it has run
+func (job *CompileJob) ownsUpload(path string) bool {
+	if path == job.ZipPath || (job.Diff != nil && path == job.Diff.OldZipPath) {
+		return true
+	}
+	if job.PostProcess != nil {
+		for _, attachment := range job.PostProcess.Attachments {
+			if path == attachment {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	// Multi-pass compilation
-	logWriter("Starting LaTeX compilation (Pass 1)")
-	output, err = runCommand(ctx, tempDir, job.Compiler, "-interaction=nonstopmode", "-halt-on-error", texFile)
-	logWriter(fmt.Sprintf("Pass 1 output:\n%s", output))
+// compileBatch compiles every document of a batch job in the shared project tree,
+// each with its own log and PDF, optionally several at a time
+func compileBatch(ctx context.Context, job *CompileJob, projectDir string, logWriter func(string)) *CompileResult {
+	workers := batchWorkers(job)
+	logWriter(fmt.Sprintf("Compiling %d documents, %d at a time", len(job.Documents), workers))
+
+	results := make([]*CompileResult, len(job.Documents))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, doc := range job.Documents {
+		wg.Add(1)
+		go func(i int, doc *Document) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			name := fmt.Sprintf("%s-%d", job.ID, i+1)
+			var result *CompileResult
+			if docLog, err := createJobLog(name); err != nil {
+				result = &CompileResult{Success: false, Message: "Failed to create log file"}
+			} else {
+				docLog.Write(fmt.Sprintf("Starting compilation - Compiler: %s, Main: %s, Draft: %t", doc.Compiler, doc.MainFile, job.Draft))
+				if doc.CompilerReason != "" {
+					docLog.Write(fmt.Sprintf("Compiler selected automatically: %s", doc.CompilerReason))
+				}
+				result = compileDocument(ctx, job, doc, projectDir, name, docLog.Write)
+				result.LogsURL = "/logs/" + name + ".log"
+				docLog.Close()
+			}
+			result.JobID = job.ID
+			result.Document = doc.MainFile
+			result.Compiler = doc.Compiler
+			result.CompilerReason = doc.CompilerReason
+			result.Draft = job.Draft
+			results[i] = result
+
+			logWriter(fmt.Sprintf("Document %s: %s", doc.MainFile, result.Message))
+		}(i, doc)
+	}
+	wg.Wait()
 
-	if err != nil {
-		logWriter(fmt.Sprintf("LaTeX pass 1 failed: %v", err))
-		job.ResponseChan <- &CompileResult{
-			Success: false,
-			Message: "LaTeX compilation failed",
-			LogsURL: "/logs/" + job.ID + ".log",
-			JobID:   job.ID,
+	succeeded := 0
+	for _, result := range results {
+		if result.Success {
+			succeeded++
 		}
-		return
 	}
 
-	// Check for bibliography files and run biber/bibtex if needed
-	bcfFile := filepath.Join(tempDir, baseName+".bcf")
-	auxFile := filepath.Join(tempDir, baseName+".aux")
+	return &CompileResult{
+		Success:   succeeded == len(results),
+		Message:   fmt.Sprintf("Compiled %d of %d documents", succeeded, len(results)),
+		LogsURL:   "/logs/" + job.ID + ".log",
+		JobID:     job.ID,
+		Documents: results,
+	}
+}
 
-	if _, err := os.Stat(bcfFile); err == nil {
-		logWriter("Running Biber for bibliography")
-		output, err := runCommand(ctx, tempDir, "biber", baseName)
-		logWriter(fmt.Sprintf("Biber output:\n%s", output))
-		if err != nil {
-			logWriter(fmt.Sprintf("Biber failed (non-fatal): %v", err))
-		}
-	} else if _, err := os.Stat(auxFile); err == nil {
-		// Check if .aux file contains \bibdata (indicating bibliography)
-		auxContent, _ := os.ReadFile(auxFile)
-		if strings.Contains(string(auxContent), "\\bibdata") {
-			logWriter("Running BibTeX for bibliography")
-			output, err := runCommand(ctx, tempDir, "bibtex", baseName)
-			logWriter(fmt.Sprintf("BibTeX output:\n%s", output))
-			if err != nil {
-				logWriter(fmt.Sprintf("BibTeX failed (non-fatal): %v", err))
-			}
+// Documents sharing a base name write the same .aux/.pdf in the project root,
+// so they can only be compiled one after another
+func batchWorkers(job *CompileJob) int {
+	if !job.Parallel {
+		return 1
+	}
+	seen := make(map[string]bool)
+	for _, doc := range job.Documents {
+		base := filepath.Base(doc.MainFile)
+		if seen[base] {
+			return 1
 		}
+		seen[base] = true
 	}
+	if len(job.Documents) < BatchParallelism {
+		return len(job.Documents)
+	}
+	return BatchParallelism
+}
 
-	// Second pass to resolve references
-	logWriter("Starting LaTeX compilation (Pass 2)")
-	output, err = runCommand(ctx, tempDir, job.Compiler, "-interaction=nonstopmode", "-halt-on-error", texFile)
-	logWriter(fmt.Sprintf("Pass 2 output:\n%s", output))
-
-	if err != nil {
-		logWriter(fmt.Sprintf("LaTeX pass 2 failed: %v", err))
-		job.ResponseChan <- &CompileResult{
+// compileDocument runs the engine passes, bibliography tools and post-processing
+// for one root document, applies the job's PDF operations and copies the PDF to
+// FilesDir/<outputName>.pdf
+func compileDocument(ctx context.Context, job *CompileJob, doc *Document, projectDir, outputName string, logWriter func(string)) *CompileResult {
+	result := pipeline.Compile(ctx, projectDir, doc.MainFile, doc.Engine, pipeline.Options{
+		Draft:       job.Draft,
+		Jobname:     job.Jobname,
+		Macros:      job.Macros,
+		Preamble:    job.Profile.preambleFor(doc.MainFile),
+		WrapperName: "texcompiler-" + outputName + ".tex",
+	}, logWriter)
+	if !result.Success {
+		return &CompileResult{
 			Success: false,
-			Message: "LaTeX compilation failed in pass 2",
-			LogsURL: "/logs/" + job.ID + ".log",
-			JobID:   job.ID,
+			Message: result.Message,
 		}
-		return
 	}
 
-	// Final pass to ensure everything is resolved
-	logWriter("Starting LaTeX compilation (Pass 3)")
-	output, err = runCommand(ctx, tempDir, job.Compiler, "-interaction=nonstopmode", "-halt-on-error", texFile)
-	logWriter(fmt.Sprintf("Pass 3 output:\n%s", output))
-
-	if err != nil {
-		logWriter(fmt.Sprintf("LaTeX pass 3 failed: %v", err))
-		job.ResponseChan <- &CompileResult{
-			Success: false,
-			Message: "LaTeX compilation failed in final pass",
-			LogsURL: "/logs/" + job.ID + ".log",
-			JobID:   job.ID,
+	if job.PostProcess != nil {
+		if err := job.PostProcess.Apply(ctx, result.PDFPath, logWriter); err != nil {
+			logWriter(fmt.Sprintf("Post-processing failed: %v", err))
+			return &CompileResult{
+				Success: false,
+				Message: fmt.Sprintf("PDF post-processing failed: %v", err),
+			}
 		}
-		return
 	}
 
-	// Check if PDF was generated
-	pdfPath := filepath.Join(tempDir, baseName+".pdf")
-	if _, err := os.Stat(pdfPath); os.IsNotExist(err) {
-		logWriter("PDF file was not generated")
-		job.ResponseChan <- &CompileResult{
-			Success: false,
-			Message: "PDF file was not generated",
-			LogsURL: "/logs/" + job.ID + ".log",
-			JobID:   job.ID,
+	compliance, failure := checkCompliance(ctx, job, result.PDFPath, logWriter)
+	if failure != "" {
+		return &CompileResult{
+			Success:    false,
+			Message:    failure,
+			Compliance: compliance,
 		}
-		return
 	}
 
 	// Copy PDF to output directory
-	outputPDF := filepath.Join(FilesDir, job.ID+".pdf")
-	if err := copyFile(pdfPath, outputPDF); err != nil {
+	outputPDF := filepath.Join(FilesDir, outputName+".pdf")
+	if err := copyFile(result.PDFPath, outputPDF); err != nil {
 		logWriter(fmt.Sprintf("Failed to copy PDF: %v", err))
-		job.ResponseChan <- &CompileResult{
+		return &CompileResult{
 			Success: false,
 			Message: "Failed to save PDF",
-			LogsURL: "/logs/" + job.ID + ".log",
-			JobID:   job.ID,
 		}
-		return
+	}
+
+	var stats *DocumentStats
+	if job.Stats {
+		stats = documentStats(ctx, projectDir, doc.MainFile, outputPDF, logWriter)
 	}
 
 	logWriter("Compilation completed successfully")
 
-	job.ResponseChan <- &CompileResult{
-		Success: true,
-		Message: "Compilation completed successfully",
-		LogsURL: "/logs/" + job.ID + ".log",
-		PDFURL:  "/files/" + job.ID + ".pdf",
-		JobID:   job.ID,
+	return &CompileResult{
+		Success:    true,
+		Message:    result.Message,
+		PDFURL:     "/files/" + outputName + ".pdf",
+		Compliance: compliance,
+		Stats:      stats,
+	}
+}
+
+// Timestamped log file in LogsDir, safe for concurrent writers
+type jobLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func createJobLog(name string) (*jobLog, error) {
+	file, err := os.Create(filepath.Join(LogsDir, name+".log"))
+	if err != nil {
+		return nil, err
 	}
+	return &jobLog{file: file}, nil
+}
+
+func (l *jobLog) Write(message string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	timestamp := time.Now().Format("2006-01-02 15:04:05")
+	logLine := fmt.Sprintf("[%s] %s\n", timestamp, message)
+	l.file.WriteString(logLine)
+	l.file.Sync()
+}
+
+func (l *jobLog) Close() {
+	l.file.Close()
 }
 
 func handleLogs(w http.ResponseWriter, r *http.Request) {
@@ -451,23 +1062,39 @@ func handleFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/pdf")
+	contentType := "application/pdf"
+	switch filepath.Ext(filename) {
+	case ".zip":
+		contentType = "application/zip"
+	case ".tex":
+		contentType = "application/x-tex"
+	}
+	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
 	http.ServeFile(w, r, filePath)
 }
 
+// How long a job's logs and outputs stay available, shortened by tests
+var cleanupDelay = CleanupDelay
+
 func scheduleCleanup(jobID string) {
-	time.Sleep(CleanupDelay)
+	time.Sleep(cleanupDelay)
 
-	logFile := filepath.Join(LogsDir, jobID+".log")
-	pdfFile := filepath.Join(FilesDir, jobID+".pdf")
+	logFiles, _ := filepath.Glob(filepath.Join(LogsDir, jobID+"-*.log"))
+	outputFiles, _ := filepath.Glob(filepath.Join(FilesDir, jobID+"-*.pdf"))
+	logFiles = append(logFiles, filepath.Join(LogsDir, jobID+".log"))
+	outputFiles = append(outputFiles, filepath.Join(FilesDir, jobID+".pdf"), filepath.Join(FilesDir, jobID+".zip"), filepath.Join(FilesDir, jobID+"-diff.tex"))
 
-	if err := os.Remove(logFile); err != nil && !os.IsNotExist(err) {
-		log.Printf("⚠️ Failed to cleanup log file %s: %v", logFile, err)
+	for _, logFile := range logFiles {
+		if err := os.Remove(logFile); err != nil && !os.IsNotExist(err) {
+			log.Printf("⚠️ Failed to cleanup log file %s: %v", logFile, err)
+		}
 	}
 
-	if err := os.Remove(pdfFile); err != nil && !os.IsNotExist(err) {
-		log.Printf("⚠️ Failed to cleanup PDF file %s: %v", pdfFile, err)
+	for _, outputFile := range outputFiles {
+		if err := os.Remove(outputFile); err != nil && !os.IsNotExist(err) {
+			log.Printf("⚠️ Failed to cleanup output file %s: %v", outputFile, err)
+		}
 	}
 
 	log.Printf("🧹 [%s] Files cleaned up", jobID)
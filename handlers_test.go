@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReceiveUploadsKeepsQueryOptions(t *testing.T) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("mode", "draft")
+	writer.WriteField("main", "report")
+	writer.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/compile?compiler=xelatex&main=thesis", &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	if _, err := receiveUploads(r, []string{"file"}); err != nil {
+		t.Fatalf("receiveUploads: %v", err)
+	}
+
+	for field, want := range map[string]string{
+		"compiler": "xelatex", // Only in the query string
+		"mode":     "draft",   // Only in the body
+		"main":     "report",  // In both; the body wins
+	} {
+		if got := r.FormValue(field); got != want {
+			t.Errorf("FormValue(%q) = %q, want %q", field, got, want)
+		}
+	}
+	if got := r.PostFormValue("compiler"); got != "" {
+		t.Errorf("PostFormValue(\"compiler\") = %q, want the query left out", got)
+	}
+}
@@ -29,7 +29,7 @@ func (rj *RunningJobs) GetRunningTasks() []map[string]interface{} {
 	var tasks []map[string]interface{}
 	for _, job := range rj.jobs {
 		elapsed := time.Since(job.StartTime)
-		remaining := CompilationTimeout - elapsed
+		remaining := job.Timeout - elapsed
 		if remaining < 0 {
 			remaining = 0
 		}
@@ -37,6 +37,8 @@ func (rj *RunningJobs) GetRunningTasks() []map[string]interface{} {
 		tasks = append(tasks, map[string]interface{}{
 			"job_id":         job.ID,
 			"compiler":       job.Compiler,
+			"main_file":      job.MainFile,
+			"draft":          job.Draft,
 			"elapsed_time":   elapsed.Seconds(),
 			"remaining_time": remaining.Seconds(),
 		})
@@ -44,6 +46,13 @@ func (rj *RunningJobs) GetRunningTasks() []map[string]interface{} {
 	return tasks
 }
 
+func (rj *RunningJobs) Has(jobID string) bool {
+	rj.mu.RLock()
+	defer rj.mu.RUnlock()
+	_, ok := rj.jobs[jobID]
+	return ok
+}
+
 func (rj *RunningJobs) Count() int {
 	rj.mu.RLock()
 	defer rj.mu.RUnlock()
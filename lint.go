@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lacheck's warning lines, e.g. "./main.tex", line 12: possible unwanted space at "{"
+var lacheckLineRe = regexp.MustCompile(`^"(.+)", line (\d+): (.*)$`)
+
+// parseLintOptions reads a lint ruleset from the 'ignore' and 'lacheck' form
+// fields (or their lint_ variants when linting on compile). ignore is a
+// comma-separated list of chktex warning numbers.
+func parseLintOptions(ignore, lacheck string) (*LintOptions, error) {
+	opts := &LintOptions{Lacheck: lacheck == "true"}
+	for _, field := range strings.Split(ignore, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 1 || n > 99 {
+			return nil, fmt.Errorf("%q is not a chktex warning number", field)
+		}
+		opts.Ignore = append(opts.Ignore, n)
+	}
+
+	tools := []string{"chktex"}
+	if opts.Lacheck {
+		tools = append(tools, "lacheck")
+	}
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			return nil, &missingToolError{tool: tool}
+		}
+	}
+	return opts, nil
+}
+
+// Checks an uploaded project with chktex and, optionally, lacheck without
+// compiling it, so it doesn't take a compilation slot
+func handleLint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxArchiveSize)
+	uploadPath, uploadName, err := receiveUpload(r)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, fmt.Sprintf("Upload exceeds %d MB", MaxArchiveSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	if uploadPath == "" {
+		http.Error(w, "No file uploaded", http.StatusBadRequest)
+		return
+	}
+	defer os.Remove(uploadPath)
+
+	opts, err := parseLintOptions(r.FormValue("ignore"), r.FormValue("lacheck"))
+	if err != nil {
+		respondLintError(w, err)
+		return
+	}
+
+	project := readProjectSources(w, uploadPath, uploadName)
+	if project == nil {
+		return
+	}
+
+	tempDir := filepath.Join(WorkDir, generateID())
+	defer os.RemoveAll(tempDir)
+	projectDir, err := project.writeTo(tempDir, uploadPath)
+	if err != nil {
+		log.Printf("❌ Failed to unpack project for linting: %v", err)
+		http.Error(w, "Failed to unpack the project", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), LintTimeout)
+	defer cancel()
+	report, err := lintProject(ctx, opts, projectDir)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Linting failed: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Writes the response for a parseLintOptions error
+func respondLintError(w http.ResponseWriter, err error) {
+	var missingTool *missingToolError
+	if errors.As(err, &missingTool) {
+		http.Error(w, fmt.Sprintf("Invalid lint options: %v", err), http.StatusNotImplemented)
+		return
+	}
+	http.Error(w, fmt.Sprintf("Invalid lint options: %v", err), http.StatusBadRequest)
+}
+
+// lintOnCompile lints a job's project before it is compiled. Findings don't fail
+// the compilation, and neither does a linter error, which is only logged.
+func lintOnCompile(ctx context.Context, opts *LintOptions, projectDir string, logWriter func(string)) *LintReport {
+	ctx, cancel := context.WithTimeout(ctx, LintTimeout)
+	defer cancel()
+
+	logWriter("Linting .tex files")
+	report, err := lintProject(ctx, opts, projectDir)
+	if err != nil {
+		logWriter(fmt.Sprintf("Linting failed: %v", err))
+		return nil
+	}
+	logWriter(fmt.Sprintf("Lint found %d warnings in %d files", len(report.Warnings), report.Files))
+	return report
+}
+
+// lintProject runs the linters over every .tex file under projectDir and returns
+// their findings ordered by file and position
+func lintProject(ctx context.Context, opts *LintOptions, projectDir string) (*LintReport, error) {
+	files, err := lintableFiles(projectDir)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &LintReport{Files: len(files), Warnings: []*LintWarning{}}
+	seen := make(map[string]bool)
+	for _, file := range files {
+		warnings, err := runChktex(ctx, opts, projectDir, file)
+		if err != nil {
+			return nil, err
+		}
+		report.Warnings = append(report.Warnings, warnings...)
+
+		if !opts.Lacheck {
+			continue
+		}
+		// lacheck follows \input, so files can be reported more than once
+		warnings, err = runLacheck(ctx, projectDir, file)
+		if err != nil {
+			return nil, err
+		}
+		for _, warning := range warnings {
+			key := fmt.Sprintf("%s:%d:%s", warning.File, warning.Line, warning.Message)
+			if !seen[key] {
+				seen[key] = true
+				report.Warnings = append(report.Warnings, warning)
+			}
+		}
+	}
+
+	sort.SliceStable(report.Warnings, func(i, j int) bool {
+		a, b := report.Warnings[i], report.Warnings[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return report, nil
+}
+
+// The .tex files under dir as slash-separated relative paths, leaving out the
+// wrappers generated for macros and compliance profiles
+func lintableFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".tex") || strings.HasPrefix(d.Name(), "texcompiler-") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// Runs chktex on one file without following \input, since every file is linted.
+// A .chktexrc at the project root is read on top of the system configuration.
+func runChktex(ctx context.Context, opts *LintOptions, projectDir, file string) ([]*LintWarning, error) {
+	args := []string{"-q", "-I0", `-f%l:%c:%n:%k:%m\n`}
+	if _, err := os.Stat(filepath.Join(projectDir, ".chktexrc")); err == nil {
+		args = append(args, "-l", ".chktexrc")
+	}
+	for _, n := range opts.Ignore {
+		args = append(args, fmt.Sprintf("-n%d", n))
+	}
+	args = append(args, file)
+
+	output, err := runLinter(ctx, projectDir, "chktex", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var warnings []*LintWarning
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(line, ":", 5)
+		if len(fields) != 5 {
+			continue
+		}
+		lineNumber, err1 := strconv.Atoi(fields[0])
+		column, err2 := strconv.Atoi(fields[1])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		warnings = append(warnings, &LintWarning{
+			File:     file,
+			Line:     lineNumber,
+			Column:   column,
+			Tool:     "chktex",
+			Rule:     fields[2],
+			Severity: strings.ToLower(fields[3]),
+			Message:  strings.TrimSpace(fields[4]),
+		})
+	}
+	return warnings, nil
+}
+
+func runLacheck(ctx context.Context, projectDir, file string) ([]*LintWarning, error) {
+	output, err := runLinter(ctx, projectDir, "lacheck", file)
+	if err != nil {
+		return nil, err
+	}
+
+	var warnings []*LintWarning
+	for _, line := range strings.Split(output, "\n") {
+		m := lacheckLineRe.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		lineNumber, _ := strconv.Atoi(m[2])
+		warnings = append(warnings, &LintWarning{
+			File:     filepath.ToSlash(filepath.Clean(m[1])),
+			Line:     lineNumber,
+			Tool:     "lacheck",
+			Severity: "warning",
+			Message:  m[3],
+		})
+	}
+	return warnings, nil
+}
+
+// Runs a linter in projectDir and returns its standard output. Linters exit
+// non-zero when they report problems, so that alone is not a failure.
+func runLinter(ctx context.Context, projectDir, command string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Dir = projectDir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("%s timed out", command)
+	}
+	var exitErr *exec.ExitError
+	if err != nil && (!errors.As(err, &exitErr) || (stdout.Len() == 0 && stderr.Len() > 0)) {
+		return "", fmt.Errorf("%s failed: %v: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
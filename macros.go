@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"tex-compiler/pipeline"
+)
+
+var (
+	jobnameRe   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+	macroNameRe = regexp.MustCompile(`^[A-Za-z]{1,64}$`)
+)
+
+// parseMacros decodes the 'macros' form field, a JSON object of macro names to
+// plain-text values. Names must be letters only so they form a single control word.
+func parseMacros(raw string) (map[string]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var macros map[string]string
+	if err := json.Unmarshal([]byte(raw), &macros); err != nil {
+		return nil, fmt.Errorf("macros must be a JSON object of strings: %w", err)
+	}
+	if err := validateMacros(macros); err != nil {
+		return nil, err
+	}
+	return macros, nil
+}
+
+// Checks the macro count, names and value sizes
+func validateMacros(macros map[string]string) error {
+	if len(macros) > MaxMacros {
+		return fmt.Errorf("at most %d macros are allowed", MaxMacros)
+	}
+	for name, value := range macros {
+		if !macroNameRe.MatchString(name) {
+			return fmt.Errorf("invalid macro name %q: use letters only", name)
+		}
+		if len(value) > MaxMacroValueBytes {
+			return fmt.Errorf("value of macro %s exceeds %d bytes", name, MaxMacroValueBytes)
+		}
+	}
+	return nil
+}
+
+// checkPredefinedMacros rejects macro names that LaTeX or the class of one of the
+// documents already defines, since \newcommand would stop every build on them
+func checkPredefinedMacros(names []string, documents []*Document, texSources map[string][]byte) error {
+	var predefined []string
+	for _, name := range names {
+		for _, doc := range documents {
+			var class string
+			if m := documentClassRe.FindStringSubmatch(pipeline.StripTeXComments(string(texSources[doc.MainFile+".tex"]))); m != nil {
+				class = strings.TrimSpace(m[1])
+			}
+			if pipeline.PredefinedCommand(name, class) {
+				predefined = append(predefined, `\`+name)
+				break
+			}
+		}
+	}
+	if len(predefined) == 0 {
+		return nil
+	}
+	sort.Strings(predefined)
+	return fmt.Errorf("LaTeX or the document class already defines %s; use other names", strings.Join(predefined, ", "))
+}
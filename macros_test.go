@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckPredefinedMacros(t *testing.T) {
+	texSources := map[string][]byte{
+		"report.tex": []byte("\\documentclass[a4paper]{article}\n\\begin{document}\\Customer\\end{document}\n"),
+		"letter.tex": []byte("% \\documentclass{article}\n\\documentclass{letter}\n\\begin{document}\\name\\end{document}\n"),
+	}
+	report := []*Document{{MainFile: "report"}}
+	letter := []*Document{{MainFile: "letter"}}
+
+	if err := checkPredefinedMacros([]string{"Customer", "name", "signature"}, report, texSources); err != nil {
+		t.Errorf("article: %v", err)
+	}
+
+	err := checkPredefinedMacros([]string{"signature", "Customer", "title", "name"}, letter, texSources)
+	if err == nil || !strings.Contains(err.Error(), `\name, \signature, \title;`) {
+		t.Errorf("letter: err = %v, want \\name, \\signature and \\title listed", err)
+	}
+}
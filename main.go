@@ -4,25 +4,58 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 )
 
 var runningJobs = NewRunningJobs()
+var engines = NewEngineRegistry()
+var workspaces = NewWorkspaces()
+var asyncJobs = NewAsyncJobs()
+var templates = NewTemplateRegistry()
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
+	// Workspaces are tracked in memory, so leftovers from a previous run are unreachable
+	os.RemoveAll(WorkspacesDir)
+
 	// Create necessary directories
-	for _, dir := range []string{WorkDir, OutputDir, LogsDir, FilesDir} {
+	for _, dir := range []string{WorkDir, OutputDir, LogsDir, FilesDir, WorkspacesDir} {
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			log.Fatalf("Failed to create directory %s: %v", dir, err)
 		}
 	}
 
+	// Load engine definitions
+	if err := engines.LoadFile(enginesConfigPath()); err != nil {
+		log.Fatalf("Failed to load engines config: %v", err)
+	}
+
+	// Load templates
+	if err := templates.LoadDir(templatesDirPath()); err != nil {
+		log.Fatalf("Failed to load templates: %v", err)
+	}
+
 	// Setup HTTP routes
 	http.HandleFunc("/compile", handleCompile)
+	http.HandleFunc("/merge", handleMerge)
+	http.HandleFunc("/diff", handleDiff)
+	http.HandleFunc("/pdf/", handlePDF)
+	http.HandleFunc("/analyze/", handleAnalyze)
+	http.HandleFunc("/lint", handleLint)
 	http.HandleFunc("/logs/", handleLogs)
 	http.HandleFunc("/files/", handleFiles)
 	http.HandleFunc("/health", handleHealth)
+	http.HandleFunc("/engines", handleEngines)
+	http.HandleFunc("/jobs", handleJobs)
+	http.HandleFunc("/jobs/", handleJob)
+	http.HandleFunc("/workspaces", handleWorkspaces)
+	http.HandleFunc("/workspaces/", handleWorkspace)
+	http.HandleFunc("/templates", handleTemplates)
+	http.HandleFunc("/templates/", handleTemplate)
+
+	// Expire idle workspaces
+	go workspaces.expireLoop()
 
 	// Serve SPA from frontend/dist
 	http.HandleFunc("/", handleSPA)
@@ -30,6 +63,7 @@ func main() {
 	log.Println("🚀 Starting LaTeX Compilation Service on :8080")
 	log.Printf("📊 Max concurrent compilations: %d", MaxConcurrentJobs)
 	log.Printf("⏰ Compilation timeout: %v", CompilationTimeout)
+	log.Printf("🔧 Available engines: %s", strings.Join(engines.AvailableNames(), ", "))
 
 	if err := http.ListenAndServe(":8080", nil); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
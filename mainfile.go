@@ -0,0 +1,180 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"tex-compiler/pipeline"
+)
+
+var (
+	// % !TEX root = ../main.tex
+	magicRootRe     = regexp.MustCompile(`(?im)^[ \t]*%+[ \t]*!\s*TEX[ \t]+root[ \t]*=[ \t]*(\S.*?)[ \t]*$`)
+	documentClassRe = regexp.MustCompile(`\\documentclass\s*(?:\[[^\]]*\])?\s*\{([^}]*)\}`)
+	includeRe       = regexp.MustCompile(`\\(?:input|include|subfile|includeonly)\s*\{([^}]*)\}`)
+)
+
+// Errors from main file detection that should be reported to the client as-is
+type MainFileError struct {
+	Message    string
+	Candidates []string
+}
+
+func (e *MainFileError) Error() string {
+	return e.Message
+}
+
+// archiveRoot returns the single top-level directory wrapping every file in the
+// archive (as in Overleaf exports), or "" if files live at the top level.
+// macOS resource fork entries are ignored.
+func archiveRoot(r *zip.Reader) string {
+	root := ""
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") {
+			continue
+		}
+		first, _, found := strings.Cut(f.Name, "/")
+		if !found {
+			return ""
+		}
+		if root == "" {
+			root = first
+		} else if root != first {
+			return ""
+		}
+	}
+	return root
+}
+
+// Strips the archive root from every source path
+func relativeToRoot(sources map[string][]byte, root string) map[string][]byte {
+	if root == "" {
+		return sources
+	}
+	rel := make(map[string][]byte, len(sources))
+	for name, content := range sources {
+		if trimmed := strings.TrimPrefix(name, root+"/"); trimmed != name {
+			rel[trimmed] = content
+		}
+	}
+	return rel
+}
+
+// detectMainFile finds the root document among sources (paths relative to the
+// project root). A % !TEX root comment wins; otherwise the files containing
+// \documentclass that no other file pulls in via \input/\include are candidates,
+// with main.tex preferred when there are several. Returns the path without .tex.
+func detectMainFile(sources map[string][]byte) (string, error) {
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Honor % !TEX root if every file using it agrees on the target
+	roots := make(map[string]bool)
+	for _, name := range names {
+		if m := magicRootRe.FindSubmatch(sources[name]); m != nil {
+			target := resolveTeXPath(path.Dir(name), string(m[1]))
+			if _, ok := sources[target]; ok {
+				roots[target] = true
+			}
+		}
+	}
+	if len(roots) == 1 {
+		for target := range roots {
+			return strings.TrimSuffix(target, ".tex"), nil
+		}
+	}
+
+	candidates := rootCandidates(sources)
+	switch {
+	case len(candidates) == 1:
+		return strings.TrimSuffix(candidates[0], ".tex"), nil
+	case len(candidates) == 0:
+		if _, ok := sources["main.tex"]; ok {
+			return "main", nil
+		}
+		return "", &MainFileError{
+			Message:    "No root document found: no .tex file contains \\documentclass. Use the 'main' parameter.",
+			Candidates: names,
+		}
+	}
+
+	for _, candidate := range candidates {
+		if candidate == "main.tex" {
+			return "main", nil
+		}
+	}
+	return "", &MainFileError{
+		Message:    fmt.Sprintf("Multiple root documents found (%d). Use the 'main' parameter to pick one.", len(candidates)),
+		Candidates: candidates,
+	}
+}
+
+// rootCandidates returns the files containing \documentclass that no other file
+// pulls in via \input/\include, sorted by path
+func rootCandidates(sources map[string][]byte) []string {
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	included := make(map[string]bool)
+	for _, name := range names {
+		text := pipeline.StripTeXComments(string(sources[name]))
+		for _, m := range includeRe.FindAllStringSubmatch(text, -1) {
+			for _, ref := range strings.Split(m[1], ",") {
+				included[resolveTeXPath(".", ref)] = true
+			}
+		}
+	}
+
+	var candidates []string
+	for _, name := range names {
+		m := documentClassRe.FindStringSubmatch(pipeline.StripTeXComments(string(sources[name])))
+		if m == nil || strings.TrimSpace(m[1]) == "subfiles" || included[name] {
+			continue
+		}
+		candidates = append(candidates, name)
+	}
+	return candidates
+}
+
+// includedSources returns the main file and every source it pulls in via
+// \input/\include, following nested inclusions
+func includedSources(mainFile string, sources map[string][]byte) map[string][]byte {
+	result := make(map[string][]byte)
+	pending := []string{mainFile}
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		content, ok := sources[name]
+		if _, seen := result[name]; !ok || seen {
+			continue
+		}
+		result[name] = content
+
+		for _, m := range includeRe.FindAllStringSubmatch(pipeline.StripTeXComments(string(content)), -1) {
+			for _, ref := range strings.Split(m[1], ",") {
+				pending = append(pending, resolveTeXPath(".", ref))
+			}
+		}
+	}
+	return result
+}
+
+// Resolves a TeX file reference relative to dir, adding .tex when no extension is given
+func resolveTeXPath(dir, ref string) string {
+	ref = strings.Trim(strings.TrimSpace(ref), `"`)
+	p := path.Clean(path.Join(dir, ref))
+	if path.Ext(p) == "" {
+		p += ".tex"
+	}
+	return p
+}
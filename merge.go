@@ -0,0 +1,439 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"tex-compiler/pipeline"
+)
+
+// Characters kept when naming PDFs after a column value
+var unsafeFileNameRe = regexp.MustCompile(`[^\p{L}\p{N}._-]+`)
+
+// Compiles the uploaded project once per row of the dataset in the 'data' field,
+// with the row's columns defined as macros, and responds with a ZIP of the PDFs
+// and a report for every row
+func handleMerge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// A merge takes one job slot for all of its rows
+	if rejectIfOverloaded(w) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxArchiveSize)
+	uploadPath, uploadName, err := receiveUpload(r, "data")
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, fmt.Sprintf("Upload exceeds %d MB", MaxArchiveSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	if uploadPath == "" {
+		http.Error(w, "No file uploaded", http.StatusBadRequest)
+		return
+	}
+
+	var job *CompileJob
+	defer func() {
+		if job == nil || job.ZipPath != uploadPath {
+			os.Remove(uploadPath)
+		}
+	}()
+
+	columns, records, err := parseMergeData(r.FormValue("data"), r.FormValue("format"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid data: %v", err), http.StatusBadRequest)
+		return
+	}
+	merge, err := newMergeJob(columns, records, r.FormValue("name_column"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid data: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	project := readUploadedProject(w, r, uploadPath, uploadName)
+	if project == nil {
+		return
+	}
+	if len(project.MainFiles) > 1 {
+		http.Error(w, "A mail merge compiles a single main file", http.StatusBadRequest)
+		return
+	}
+
+	job = newCompileJob(w, r, project.MainFiles, project.TexSources)
+	if job == nil {
+		return
+	}
+	if job.Engine.JobnameArg == "" {
+		http.Error(w, fmt.Sprintf("%s does not support macros", job.Engine.Name), http.StatusBadRequest)
+		job = nil
+		return
+	}
+	if err := checkPredefinedMacros(columns, []*Document{{MainFile: job.MainFile}}, project.TexSources); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid data: columns can't be used as macros: %v", err), http.StatusBadRequest)
+		job = nil
+		return
+	}
+
+	// Row values take precedence over the macros field
+	for i, row := range merge.Rows {
+		for name, value := range job.Macros {
+			if _, ok := row.Macros[name]; !ok {
+				row.Macros[name] = value
+			}
+		}
+		if err := validateMacros(row.Macros); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid data: row %d: %v", i+1, err), http.StatusBadRequest)
+			job = nil
+			return
+		}
+	}
+
+	// Rows are compiled one after another, each with the usual timeout
+	merge.RowTimeout = job.Timeout
+	job.Timeout *= time.Duration(len(merge.Rows))
+	job.Merge = merge
+	project.attach(job, uploadPath)
+
+	runCompileJob(w, job, nil)
+}
+
+// Parses a CSV dataset with a header row, or JSON lines with one object per row.
+// format is csv or jsonl; when empty, data starting with '{' is read as JSON lines.
+func parseMergeData(data, format string) ([]string, []map[string]string, error) {
+	data = strings.TrimPrefix(data, "\ufeff") // Byte order mark
+	if strings.TrimSpace(data) == "" {
+		return nil, nil, fmt.Errorf("no dataset in the data field")
+	}
+	if format == "" {
+		format = "csv"
+		if strings.HasPrefix(strings.TrimSpace(data), "{") {
+			format = "jsonl"
+		}
+	}
+
+	var columns []string
+	var records []map[string]string
+	var err error
+	switch format {
+	case "csv":
+		columns, records, err = parseCSVData(data)
+	case "jsonl":
+		columns, records, err = parseJSONLinesData(data)
+	default:
+		return nil, nil, fmt.Errorf("unknown format %q: use csv or jsonl", format)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("the dataset has no rows")
+	}
+	if len(records) > MaxMergeRows {
+		return nil, nil, fmt.Errorf("at most %d rows are allowed", MaxMergeRows)
+	}
+	return columns, records, nil
+}
+
+func parseCSVData(data string) ([]string, []map[string]string, error) {
+	reader := csv.NewReader(strings.NewReader(data))
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	columns := make([]string, len(header))
+	seen := make(map[string]bool)
+	for i, column := range header {
+		columns[i] = strings.TrimSpace(column)
+		if seen[columns[i]] {
+			return nil, nil, fmt.Errorf("duplicate column %q", columns[i])
+		}
+		seen[columns[i]] = true
+	}
+
+	var records []map[string]string
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		record := make(map[string]string, len(columns))
+		for i, column := range columns {
+			record[column] = fields[i]
+		}
+		records = append(records, record)
+	}
+	return columns, records, nil
+}
+
+// Columns are the keys found in any object, sorted; rows without one get ""
+func parseJSONLinesData(data string) ([]string, []map[string]string, error) {
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), MaxDataFieldSize)
+
+	var columns []string
+	var records []map[string]string
+	seen := make(map[string]bool)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var object map[string]interface{}
+		decoder := json.NewDecoder(strings.NewReader(text))
+		decoder.UseNumber()
+		if err := decoder.Decode(&object); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		record := make(map[string]string, len(object))
+		for name, value := range object {
+			switch v := value.(type) {
+			case string:
+				record[name] = v
+			case json.Number:
+				record[name] = v.String()
+			case bool:
+				record[name] = strconv.FormatBool(v)
+			case nil:
+				record[name] = ""
+			default:
+				return nil, nil, fmt.Errorf("line %d: %s must be a string, number or boolean", line, name)
+			}
+			if !seen[name] {
+				seen[name] = true
+				columns = append(columns, name)
+			}
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	sort.Strings(columns)
+	for _, record := range records {
+		for _, column := range columns {
+			if _, ok := record[column]; !ok {
+				record[column] = ""
+			}
+		}
+	}
+	return columns, records, nil
+}
+
+// Checks the columns are usable as macros and names every row's PDF after
+// nameColumn, or row-<n> without one. Repeated names get a -2, -3... suffix.
+func newMergeJob(columns []string, records []map[string]string, nameColumn string) (*MergeJob, error) {
+	for _, column := range columns {
+		if !macroNameRe.MatchString(column) {
+			return nil, fmt.Errorf("column %q is not a valid macro name: use letters only", column)
+		}
+	}
+	if nameColumn != "" {
+		found := false
+		for _, column := range columns {
+			found = found || column == nameColumn
+		}
+		if !found {
+			return nil, fmt.Errorf("name_column %s is not a column of the dataset", nameColumn)
+		}
+	}
+
+	merge := &MergeJob{Columns: columns}
+	used := make(map[string]bool)
+	for i, record := range records {
+		name := ""
+		if nameColumn != "" {
+			name = mergeFileName(record[nameColumn])
+		}
+		if name == "" {
+			name = fmt.Sprintf("row-%d", i+1)
+		}
+
+		// Names are compared case-insensitively so the ZIP extracts anywhere
+		unique := name
+		for n := 2; used[strings.ToLower(unique)]; n++ {
+			unique = fmt.Sprintf("%s-%d", name, n)
+		}
+		used[strings.ToLower(unique)] = true
+
+		merge.Rows = append(merge.Rows, &MergeRow{Name: unique, Macros: record})
+	}
+	return merge, nil
+}
+
+// Turns a column value into a file name, replacing runs of other characters
+// than letters, digits, '.', '_' and '-' with '-'
+func mergeFileName(value string) string {
+	name := strings.Trim(unsafeFileNameRe.ReplaceAllString(value, "-"), "-.")
+	if runes := []rune(name); len(runes) > 100 {
+		name = strings.TrimRight(string(runes[:100]), "-.")
+	}
+	return name
+}
+
+// compileMerge compiles the main file once per dataset row in the shared project
+// tree, so every row after the first starts from the previous row's .aux, and
+// collects the PDFs and a report.json into FilesDir/<job ID>.zip
+func compileMerge(ctx context.Context, job *CompileJob, projectDir string, logWriter func(string)) *CompileResult {
+	logWriter(fmt.Sprintf("Merging %d rows, columns: %s", len(job.Merge.Rows), strings.Join(job.Merge.Columns, ", ")))
+
+	failed := func(message string, err error) *CompileResult {
+		logWriter(fmt.Sprintf("%s: %v", message, err))
+		return &CompileResult{
+			Success: false,
+			Message: message,
+			LogsURL: "/logs/" + job.ID + ".log",
+			JobID:   job.ID,
+		}
+	}
+
+	zipFile, err := os.Create(filepath.Join(FilesDir, job.ID+".zip"))
+	if err != nil {
+		return failed("Failed to create ZIP file", err)
+	}
+	defer zipFile.Close()
+	archive := zip.NewWriter(zipFile)
+
+	results := make([]*MergeRowResult, len(job.Merge.Rows))
+	succeeded := 0
+	for i, row := range job.Merge.Rows {
+		if ctx.Err() != nil {
+			results[i] = &MergeRowResult{Row: i + 1, Name: row.Name, Message: "Skipped: the job timed out"}
+			continue
+		}
+		results[i] = compileMergeRow(ctx, job, i, projectDir, archive)
+		if results[i].Success {
+			succeeded++
+		}
+		logWriter(fmt.Sprintf("Row %d (%s): %s", i+1, row.Name, results[i].Message))
+	}
+
+	report, err := archive.CreateHeader(&zip.FileHeader{Name: "report.json", Method: zip.Deflate, Modified: time.Now()})
+	if err == nil {
+		encoder := json.NewEncoder(report)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(results)
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		return failed("Failed to write ZIP file", err)
+	}
+
+	return &CompileResult{
+		Success: succeeded == len(results),
+		Message: fmt.Sprintf("Compiled %d of %d rows", succeeded, len(results)),
+		LogsURL: "/logs/" + job.ID + ".log",
+		JobID:   job.ID,
+		ZipURL:  "/files/" + job.ID + ".zip",
+		Rows:    results,
+	}
+}
+
+// Compiles one row with its own log and timeout and adds the PDF to the archive
+func compileMergeRow(ctx context.Context, job *CompileJob, index int, projectDir string, archive *zip.Writer) *MergeRowResult {
+	row := job.Merge.Rows[index]
+	result := &MergeRowResult{Row: index + 1, Name: row.Name}
+
+	logName := fmt.Sprintf("%s-%d", job.ID, index+1)
+	rowLog, err := createJobLog(logName)
+	if err != nil {
+		result.Message = "Failed to create log file"
+		return result
+	}
+	defer rowLog.Close()
+	result.LogsURL = "/logs/" + logName + ".log"
+	rowLog.Write(fmt.Sprintf("Starting compilation - Compiler: %s, Main: %s, Draft: %t, Row: %d (%s)", job.Compiler, job.MainFile, job.Draft, index+1, row.Name))
+
+	rowCtx, cancel := context.WithTimeout(ctx, job.Merge.RowTimeout)
+	defer cancel()
+	compiled := pipeline.Compile(rowCtx, projectDir, job.MainFile, job.Engine, pipeline.Options{
+		Draft:       job.Draft,
+		Jobname:     job.Jobname,
+		Macros:      row.Macros,
+		Preamble:    job.Profile.preambleFor(job.MainFile),
+		WrapperName: "texcompiler-" + job.ID + ".tex",
+	}, rowLog.Write)
+	if !compiled.Success {
+		result.Message = compiled.Message
+		if rowCtx.Err() == context.DeadlineExceeded {
+			result.Message = "Compilation timed out"
+		}
+		return result
+	}
+
+	compliance, failure := checkCompliance(rowCtx, job, compiled.PDFPath, rowLog.Write)
+	result.Compliance = compliance
+	if failure != "" {
+		os.Remove(compiled.PDFPath)
+		result.Message = failure
+		return result
+	}
+
+	if job.Stats {
+		result.Stats = documentStats(rowCtx, projectDir, job.MainFile, compiled.PDFPath, rowLog.Write)
+	}
+
+	// Every row writes the same PDF, so it is moved into the archive
+	err = addFileToZip(archive, row.Name+".pdf", compiled.PDFPath)
+	os.Remove(compiled.PDFPath)
+	if err != nil {
+		rowLog.Write(fmt.Sprintf("Failed to add PDF to ZIP: %v", err))
+		result.Message = "Failed to save PDF"
+		return result
+	}
+
+	rowLog.Write("Compilation completed successfully")
+	result.Success = true
+	result.Message = compiled.Message
+	return result
+}
+
+func addFileToZip(archive *zip.Writer, name, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	entry, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: info.ModTime()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, file)
+	return err
+}
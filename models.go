@@ -3,29 +3,208 @@ package main
 import (
 	"context"
 	"sync"
+	"text/template"
 	"time"
+
+	"tex-compiler/pipeline"
 )
 
 // Represents a single compilation job
 type CompileJob struct {
-	ID           string
-	ZipData      []byte
-	TexContent   []byte // For direct .tex file uploads
-	MainFile     string
-	Compiler     string
-	IsSingleFile bool // Flag to indicate if it's a single .tex file
-	StartTime    time.Time
-	ResponseChan chan *CompileResult
-	Cancel       context.CancelFunc
+	ID             string
+	ZipPath        string // Uploaded archive, removed once the job has run
+	TexContent     []byte // For direct .tex file uploads
+	MainFile       string
+	RootDir        string // Archive directory the project lives in, relative to the extraction dir
+	Compiler       string
+	CompilerReason string // Why the engine was chosen when compiler=auto
+	Engine         *Engine
+	IsSingleFile   bool               // Flag to indicate if it's a single .tex file
+	Draft          bool               // Fast preview: fewer passes, references may be unresolved
+	Workspace      *Workspace         // Set when compiling a persistent workspace in place
+	Template       *RenderedTemplate  // Set when compiling a template rendered with request data
+	Callback       *CallbackDelivery  // Set when the result is delivered to a callback URL
+	Documents      []*Document        // Root documents of a batch job, compiled in the same tree
+	Merge          *MergeJob          // Set for mail-merge jobs, compiled once per dataset row
+	Diff           *DiffJob           // Set for latexdiff jobs, whose project is the new version
+	PostProcess    *PostProcess       // PDF operations applied before PDFs are placed in FilesDir
+	Profile        *ComplianceProfile // PDF/A or PDF/UA standard the PDFs must meet
+	Stats          bool               // Count words and pages of every compiled document
+	Lint           *LintOptions       // Set to lint the project before compiling it
+	Jobname        string             // Output base name passed to the engine
+	Macros         map[string]string  // Plain-text macros defined before the main file is input
+	Parallel       bool               // Compile batch documents concurrently
+	StartTime      time.Time
+	Timeout        time.Duration
+	ResponseChan   chan *CompileResult
+	Done           chan struct{} // Closed once processJob has returned, even after a timeout
+	Cancel         context.CancelFunc
 }
 
 // Represents the result of a compilation
 type CompileResult struct {
+	Success        bool   `json:"success"`
+	Message        string `json:"message,omitempty"`
+	LogsURL        string `json:"logs_url,omitempty"`
+	PDFURL         string `json:"pdf_url,omitempty"`
+	JobID          string `json:"job_id"`
+	Compiler       string `json:"compiler,omitempty"`
+	CompilerReason string `json:"compiler_reason,omitempty"`
+	Draft          bool   `json:"draft,omitempty"`
+
+	// Batch jobs: Document names the root of each entry in Documents
+	Document  string           `json:"document,omitempty"`
+	Documents []*CompileResult `json:"documents,omitempty"`
+
+	// Diff jobs: the latexdiff document the PDF was compiled from
+	DiffURL string `json:"diff_url,omitempty"`
+
+	// Mail-merge jobs: ZIP of the PDFs and the outcome of every row
+	ZipURL string            `json:"zip_url,omitempty"`
+	Rows   []*MergeRowResult `json:"rows,omitempty"`
+
+	// Jobs with a compliance profile: the validation of the PDF
+	Compliance *ComplianceReport `json:"compliance,omitempty"`
+
+	// Jobs with stats: word and page counts of the document
+	Stats *DocumentStats `json:"stats,omitempty"`
+
+	// Jobs with lint: linter findings for the project's sources
+	Lint *LintReport `json:"lint,omitempty"`
+}
+
+// One step of a PDF post-processing chain
+type PDFStep struct {
+	Op       string   `json:"op"`                // pages, merge, compress, linearize or metadata
+	Pages    string   `json:"pages,omitempty"`   // pages: qpdf page range, e.g. "1-3,5,r1"
+	Before   []string `json:"before,omitempty"`  // merge: attachments inserted before the document
+	After    []string `json:"after,omitempty"`   // merge: attachments appended after it
+	Quality  string   `json:"quality,omitempty"` // compress: lossless (default), screen, ebook, printer or prepress
+	Title    string   `json:"title,omitempty"`   // metadata: document information fields to set
+	Author   string   `json:"author,omitempty"`
+	Subject  string   `json:"subject,omitempty"`
+	Keywords string   `json:"keywords,omitempty"`
+}
+
+// PDF operations applied in order to a compiled or uploaded PDF
+type PostProcess struct {
+	Steps       []*PDFStep
+	Attachments map[string]string // Uploaded PDFs by file name, removed once the job has run
+}
+
+// The old version of a latexdiff job
+type DiffJob struct {
+	Old        *uploadedProject
+	OldZipPath string // Uploaded archive, removed once the job has run
+	Flatten    bool   // Inline \input and \include files, for multi-file projects
+}
+
+// Dataset of a mail-merge job
+type MergeJob struct {
+	Columns    []string
+	Rows       []*MergeRow
+	RowTimeout time.Duration
+}
+
+// One dataset row: the PDF name and the macros it is compiled with
+type MergeRow struct {
+	Name   string
+	Macros map[string]string
+}
+
+// Outcome of one mail-merge row
+type MergeRowResult struct {
+	Row     int    `json:"row"` // 1-based, not counting a CSV header
+	Name    string `json:"name"`
 	Success bool   `json:"success"`
 	Message string `json:"message,omitempty"`
 	LogsURL string `json:"logs_url,omitempty"`
-	PDFURL  string `json:"pdf_url,omitempty"`
-	JobID   string `json:"job_id"`
+
+	Compliance *ComplianceReport `json:"compliance,omitempty"`
+	Stats      *DocumentStats    `json:"stats,omitempty"`
+}
+
+// A PDF/A or PDF/UA standard requested for a job
+type ComplianceProfile struct {
+	Name     string // pdfa-1b, pdfa-2b, pdfa-3u or pdfua
+	Preamble string // \DocumentMetadata line injected ahead of the main file
+
+	spec        *profileSpec
+	ownMetadata map[string]bool // Main files that declare \DocumentMetadata or load pdfx themselves
+}
+
+// Outcome of validating a PDF against a compliance profile
+type ComplianceReport struct {
+	Profile   string            `json:"profile"`
+	Validator string            `json:"validator"` // The tool that validated the PDF, i.e. verapdf
+	Compliant bool              `json:"compliant"`
+	Issues    []ComplianceIssue `json:"issues,omitempty"`
+}
+
+// A requirement of the standard the PDF fails
+type ComplianceIssue struct {
+	Rule         string `json:"rule"` // "<specification> <clause>-<test>", as veraPDF reports it
+	Message      string `json:"message"`
+	FailedChecks int    `json:"failed_checks,omitempty"`
+}
+
+// Word counts of a document from texcount
+type DocumentStats struct {
+	Document string          `json:"document,omitempty"` // Main file, for /analyze/wordcount
+	Totals   WordCounts      `json:"totals"`
+	Sections []*SectionStats `json:"sections,omitempty"` // Parts, chapters and sections in document order
+	Pages    int             `json:"pages,omitempty"`    // Of the compiled PDF
+	Warnings []string        `json:"warnings,omitempty"`
+}
+
+// texcount's counts for a document or section
+type WordCounts struct {
+	Words       int `json:"words"` // Text, headers and captions
+	Text        int `json:"text"`
+	Headers     int `json:"headers"`
+	Captions    int `json:"captions"` // And other words outside the running text
+	HeaderCount int `json:"header_count"`
+	FloatCount  int `json:"float_count"`
+	InlineMath  int `json:"inline_math"`
+	DisplayMath int `json:"display_math"`
+}
+
+// Counts of one section; level "top" is the text before the first heading
+type SectionStats struct {
+	Level string `json:"level"` // part, chapter, section, ...
+	Title string `json:"title,omitempty"`
+	WordCounts
+}
+
+// Ruleset of a lint run
+type LintOptions struct {
+	Ignore  []int // chktex warning numbers to suppress
+	Lacheck bool  // Run lacheck as well as chktex
+}
+
+// Linter findings for a project
+type LintReport struct {
+	Files    int            `json:"files"` // .tex files checked
+	Warnings []*LintWarning `json:"warnings"`
+}
+
+// One linter finding
+type LintWarning struct {
+	File     string `json:"file"` // Relative to the project root
+	Line     int    `json:"line"`
+	Column   int    `json:"column,omitempty"` // chktex only
+	Tool     string `json:"tool"`             // chktex or lacheck
+	Rule     string `json:"rule,omitempty"`   // chktex warning number
+	Severity string `json:"severity"`         // warning, error or message
+	Message  string `json:"message"`
+}
+
+// A root document to compile and the engine chosen for it
+type Document struct {
+	MainFile       string
+	Compiler       string
+	CompilerReason string
+	Engine         *Engine
 }
 
 // Running jobs tracker
@@ -33,3 +212,67 @@ type RunningJobs struct {
 	mu   sync.RWMutex
 	jobs map[string]*CompileJob
 }
+
+// Describes how to drive a TeX engine
+type Engine = pipeline.Engine
+
+// Configured engines, keyed by name
+type EngineRegistry struct {
+	mu      sync.RWMutex
+	engines map[string]*Engine
+	order   []string
+}
+
+// A project registered as a template, rendered with request data before compiling
+type Template struct {
+	Name        string
+	Dir         string
+	Description string
+	MainFile    string // Relative to Dir, without .tex
+	Compiler    string
+	Schema      *Schema
+	sources     map[string]*template.Template // Rendered files by slash-separated path relative to Dir
+}
+
+// Sources of a template rendered for one request
+type RenderedTemplate struct {
+	Template *Template
+	Files    map[string][]byte // Replace the template's files of the same path
+}
+
+// Registered templates, keyed by name
+type TemplateRegistry struct {
+	mu        sync.RWMutex
+	templates map[string]*Template
+}
+
+// A persistent project directory that keeps build artifacts between compiles
+type Workspace struct {
+	ID        string
+	Dir       string
+	CreatedAt time.Time
+	mu        sync.Mutex // Held while compiling or changing files
+	lastUsed  time.Time  // Guarded by Workspaces.mu
+}
+
+// Workspaces tracker
+type Workspaces struct {
+	mu         sync.Mutex
+	workspaces map[string]*Workspace
+}
+
+// Webhook delivery state for a job submitted with a callback URL
+type CallbackDelivery struct {
+	URL         string     `json:"url"`
+	Status      string     `json:"status"` // pending, delivered or failed
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+// Callback jobs tracker, kept until their delivery has settled
+type AsyncJobs struct {
+	mu      sync.RWMutex
+	jobs    map[string]*CompileJob
+	results map[string]*CompileResult
+}
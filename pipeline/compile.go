@@ -0,0 +1,246 @@
+// Package pipeline runs TeX engines over a project directory: the engine passes,
+// bibliography tools and post-processing shared by the server and the CLI.
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Options tweaking how a document is compiled
+type Options struct {
+	Draft   bool              // Fewest passes that still produce a PDF
+	Jobname string            // Names the outputs instead of the main file
+	Macros  map[string]string // Defined as plain-text macros before the main file is read
+	// TeX code placed ahead of the macros and the main file, e.g. \DocumentMetadata
+	Preamble string
+	// File name of the generated wrapper, defaults to texcompiler-<jobname>.tex
+	WrapperName string
+}
+
+// Outcome of compiling one document
+type Result struct {
+	Success bool
+	Message string
+	PDFPath string // Generated PDF inside the project directory
+}
+
+// Compile runs the engine passes, bibliography tools and post-processing for
+// mainFile (relative to projectDir, with or without .tex), reporting progress
+// and tool output through logWriter
+func Compile(ctx context.Context, projectDir, mainFile string, engine *Engine, opts Options, logWriter func(string)) *Result {
+	texFile := filepath.Join(projectDir, mainFile)
+	if !strings.HasSuffix(mainFile, ".tex") {
+		texFile += ".tex"
+	}
+
+	if _, err := os.Stat(texFile); os.IsNotExist(err) {
+		logWriter(fmt.Sprintf("Main file not found: %s", mainFile))
+		return &Result{
+			Success: false,
+			Message: fmt.Sprintf("Main file not found: %s", mainFile),
+		}
+	}
+
+	// Get base name for output files
+	baseName := strings.TrimSuffix(filepath.Base(texFile), ".tex")
+
+	// Parametrized builds compile a generated wrapper that holds the preamble, defines
+	// the macros and inputs the main file, keeping the main file's name for the outputs
+	jobname := opts.Jobname
+	if len(opts.Macros) > 0 || opts.Preamble != "" {
+		if jobname == "" {
+			jobname = baseName
+		}
+		wrapperName := opts.WrapperName
+		if wrapperName == "" {
+			wrapperName = "texcompiler-" + jobname + ".tex"
+		}
+		mainPath, _ := filepath.Rel(projectDir, texFile)
+		wrapper := filepath.Join(projectDir, wrapperName)
+		if err := os.WriteFile(wrapper, wrapperSource(opts.Preamble, opts.Macros, filepath.ToSlash(mainPath)), 0644); err != nil {
+			logWriter(fmt.Sprintf("Failed to write macro wrapper: %v", err))
+			return &Result{
+				Success: false,
+				Message: "Failed to create macro wrapper",
+			}
+		}
+		defer os.Remove(wrapper)
+		if opts.Preamble != "" {
+			logWriter(fmt.Sprintf("Injecting %s via %s", strings.TrimSpace(opts.Preamble), wrapperName))
+		}
+		if len(opts.Macros) > 0 {
+			logWriter(fmt.Sprintf("Injecting %d macros via %s", len(opts.Macros), wrapperName))
+		}
+		texFile = wrapper
+	}
+	if jobname != "" {
+		baseName = jobname
+	}
+
+	// The engine runs in projectDir on the relative path, so the log names project
+	// files as ./chapter.tex rather than by their location on this machine
+	texFile, _ = filepath.Rel(projectDir, texFile)
+
+	// Draft builds skip bibliography tools while the .bbl is newer than every .bib,
+	// which leaves a single pass
+	runBibliography := !engine.SelfContained
+	if opts.Draft && runBibliography {
+		runBibliography = bibliographyStale(projectDir, baseName)
+		if !runBibliography {
+			logWriter("Draft mode: bibliography is up to date, running a single pass")
+		}
+	}
+
+	runPass := func(pass int, args []string) error {
+		logWriter(fmt.Sprintf("Starting LaTeX compilation (Pass %d)", pass))
+		output, err := runCommand(ctx, projectDir, engine.Command, args...)
+		logWriter(fmt.Sprintf("Pass %d output:\n%s", pass, output))
+
+		if err != nil {
+			logWriter(fmt.Sprintf("LaTeX pass %d failed: %v", pass, err))
+		}
+		return err
+	}
+
+	// Multi-pass compilation
+	firstPassArgs := engine.CompileArgs(texFile, jobname)
+	if opts.Draft && runBibliography {
+		// Another pass follows, so the first one doesn't need to write output
+		firstPassArgs = engine.DraftCompileArgs(texFile, jobname)
+	}
+	if err := runPass(1, firstPassArgs); err != nil {
+		return &Result{
+			Success: false,
+			Message: "LaTeX compilation failed",
+		}
+	}
+
+	// Check for bibliography files and run biber/bibtex if needed
+	bcfFile := filepath.Join(projectDir, baseName+".bcf")
+	auxFile := filepath.Join(projectDir, baseName+".aux")
+
+	if engine.SelfContained {
+		logWriter(fmt.Sprintf("%s handles reruns and bibliography itself, skipping extra passes", engine.Name))
+	} else if !runBibliography {
+		// Draft with an up-to-date .bbl
+	} else if _, err := os.Stat(bcfFile); err == nil {
+		logWriter("Running Biber for bibliography")
+		output, err := runCommand(ctx, projectDir, "biber", baseName)
+		logWriter(fmt.Sprintf("Biber output:\n%s", output))
+		if err != nil {
+			logWriter(fmt.Sprintf("Biber failed (non-fatal): %v", err))
+		}
+	} else if _, err := os.Stat(auxFile); err == nil {
+		// Check if .aux file contains \bibdata (indicating bibliography)
+		auxContent, _ := os.ReadFile(auxFile)
+		if strings.Contains(string(auxContent), "\\bibdata") {
+			logWriter("Running BibTeX for bibliography")
+			output, err := runCommand(ctx, projectDir, engine.BibTeXCommand(), baseName)
+			logWriter(fmt.Sprintf("BibTeX output:\n%s", output))
+			if err != nil {
+				logWriter(fmt.Sprintf("BibTeX failed (non-fatal): %v", err))
+			}
+		}
+	}
+
+	switch {
+	case engine.SelfContained:
+	case opts.Draft:
+		// One more pass to pick up the bibliography, if it was rebuilt
+		if runBibliography {
+			if err := runPass(2, engine.CompileArgs(texFile, jobname)); err != nil {
+				return &Result{
+					Success: false,
+					Message: "LaTeX compilation failed in final pass",
+				}
+			}
+		}
+	default:
+		// Second pass to resolve references
+		if err := runPass(2, engine.CompileArgs(texFile, jobname)); err != nil {
+			return &Result{
+				Success: false,
+				Message: "LaTeX compilation failed in pass 2",
+			}
+		}
+
+		// Final pass to ensure everything is resolved
+		if err := runPass(3, engine.CompileArgs(texFile, jobname)); err != nil {
+			return &Result{
+				Success: false,
+				Message: "LaTeX compilation failed in final pass",
+			}
+		}
+	}
+
+	// Convert engine output (e.g. DVI) to PDF
+	if command, args := engine.PostProcessArgs(baseName); command != "" {
+		logWriter(fmt.Sprintf("Running %s", command))
+		output, err := runCommand(ctx, projectDir, command, args...)
+		logWriter(fmt.Sprintf("%s output:\n%s", command, output))
+
+		if err != nil {
+			logWriter(fmt.Sprintf("%s failed: %v", command, err))
+			return &Result{
+				Success: false,
+				Message: fmt.Sprintf("Post-processing with %s failed", command),
+			}
+		}
+	}
+
+	// Check if PDF was generated
+	pdfPath := filepath.Join(projectDir, baseName+".pdf")
+	if _, err := os.Stat(pdfPath); os.IsNotExist(err) {
+		logWriter("PDF file was not generated")
+		return &Result{
+			Success: false,
+			Message: "PDF file was not generated",
+		}
+	}
+
+	return &Result{
+		Success: true,
+		Message: "Compilation completed successfully",
+		PDFPath: pdfPath,
+	}
+}
+
+func runCommand(ctx context.Context, dir, command string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Dir = dir
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return out.String(), fmt.Errorf("command %s timed out", command)
+	}
+	return out.String(), err
+}
+
+// Reports whether bibliography tools need to run: the project has .bib files and
+// <baseName>.bbl is missing or older than the newest of them
+func bibliographyStale(dir, baseName string) bool {
+	var newestBib time.Time
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(strings.ToLower(path), ".bib") && info.ModTime().After(newestBib) {
+			newestBib = info.ModTime()
+		}
+		return nil
+	})
+	if newestBib.IsZero() {
+		return false
+	}
+
+	bbl, err := os.Stat(filepath.Join(dir, baseName+".bbl"))
+	return err != nil || newestBib.After(bbl.ModTime())
+}
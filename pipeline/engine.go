@@ -0,0 +1,187 @@
+package pipeline
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Engine used when nothing else asks for a specific one
+const DefaultEngine = "pdflatex"
+
+var (
+	// % !TEX program = xelatex, % !TEX TS-program = lualatex
+	magicProgramRe = regexp.MustCompile(`(?im)^[ \t]*%+[ \t]*!\s*TEX[ \t]+(?:TS-)?program[ \t]*=[ \t]*([A-Za-z0-9_-]+)`)
+	packageRe      = regexp.MustCompile(`\\(?:usepackage|RequirePackage)\s*(?:\[[^\]]*\])?\s*\{([^}]*)\}`)
+	directLuaRe    = regexp.MustCompile(`\\(?:directlua|luaexec)\b`)
+)
+
+// Alternative spellings accepted in magic comments
+var engineAliases = map[string]string{
+	"pdftex": "pdflatex",
+	"xetex":  "xelatex",
+	"luatex": "lualatex",
+}
+
+// Packages that only work (or only work well) with a specific engine, most specific first
+var packageEngines = []struct {
+	pkg    string
+	engine string
+}{
+	{"luacode", "lualatex"},
+	{"luatexja", "lualatex"},
+	{"luatexja-fontspec", "lualatex"},
+	{"luaotfload", "lualatex"},
+	{"luatexbase", "lualatex"},
+	{"xeCJK", "xelatex"},
+	{"xunicode", "xelatex"},
+	{"xltxtra", "xelatex"},
+	{"fontspec", "xelatex"},
+	{"polyglossia", "xelatex"},
+	{"unicode-math", "xelatex"},
+}
+
+// Describes how to drive a TeX engine
+type Engine struct {
+	Name        string   `json:"name"`
+	Command     string   `json:"command"`
+	Args        []string `json:"args"`
+	OutputExt   string   `json:"output_ext"`
+	PostProcess []string `json:"post_process,omitempty"` // Converts <base><OutputExt> into a PDF, e.g. ["dvipdfmx"]
+	BibTeX      string   `json:"bibtex,omitempty"`       // BibTeX variant, defaults to bibtex
+	DraftArgs   []string `json:"draft_args,omitempty"`   // Extra args for passes whose output is thrown away
+	JobnameArg  string   `json:"jobname_arg,omitempty"`  // Option prefix naming the outputs, e.g. "-jobname="; empty if unsupported
+	// Engine handles reruns and bibliography itself (e.g. tectonic)
+	SelfContained bool `json:"self_contained,omitempty"`
+}
+
+// DefaultEngines returns the engines known out of the box
+func DefaultEngines() []*Engine {
+	texArgs := []string{"-interaction=nonstopmode", "-halt-on-error", "-file-line-error"}
+	draftMode := []string{"-draftmode"}
+	jobname := "-jobname="
+	return []*Engine{
+		{Name: "pdflatex", Command: "pdflatex", Args: texArgs, OutputExt: ".pdf", JobnameArg: jobname, DraftArgs: draftMode},
+		{Name: "lualatex", Command: "lualatex", Args: texArgs, OutputExt: ".pdf", JobnameArg: jobname, DraftArgs: draftMode},
+		{Name: "xelatex", Command: "xelatex", Args: texArgs, OutputExt: ".pdf", JobnameArg: jobname, DraftArgs: []string{"-no-pdf"}},
+		{Name: "lualatex-dev", Command: "lualatex-dev", Args: texArgs, OutputExt: ".pdf", JobnameArg: jobname, DraftArgs: draftMode},
+		{Name: "latex", Command: "latex", Args: texArgs, OutputExt: ".dvi", JobnameArg: jobname, PostProcess: []string{"dvipdfmx"}},
+		{Name: "platex", Command: "platex", Args: texArgs, OutputExt: ".dvi", JobnameArg: jobname, PostProcess: []string{"dvipdfmx"}, BibTeX: "pbibtex"},
+		{Name: "uplatex", Command: "uplatex", Args: texArgs, OutputExt: ".dvi", JobnameArg: jobname, PostProcess: []string{"dvipdfmx"}, BibTeX: "upbibtex"},
+		{Name: "tectonic", Command: "tectonic", Args: []string{"--keep-logs", "--keep-intermediates"}, OutputExt: ".pdf", SelfContained: true},
+	}
+}
+
+// Available reports whether the engine and its post-processing tool are on PATH
+func (e *Engine) Available() bool {
+	if _, err := exec.LookPath(e.Command); err != nil {
+		return false
+	}
+	if len(e.PostProcess) > 0 {
+		if _, err := exec.LookPath(e.PostProcess[0]); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// CompileArgs returns the engine arguments for compiling texFile, naming the
+// outputs after jobname when it is set
+func (e *Engine) CompileArgs(texFile, jobname string) []string {
+	args := append([]string{}, e.Args...)
+	if jobname != "" {
+		args = append(args, e.JobnameArg+jobname)
+	}
+	return append(args, texFile)
+}
+
+// DraftCompileArgs returns the arguments for an intermediate pass whose output is not kept
+func (e *Engine) DraftCompileArgs(texFile, jobname string) []string {
+	args := append([]string{}, e.Args...)
+	args = append(args, e.DraftArgs...)
+	if jobname != "" {
+		args = append(args, e.JobnameArg+jobname)
+	}
+	return append(args, texFile)
+}
+
+// BibTeXCommand returns the BibTeX program matching this engine
+func (e *Engine) BibTeXCommand() string {
+	if e.BibTeX != "" {
+		return e.BibTeX
+	}
+	return "bibtex"
+}
+
+// PostProcessArgs returns the post-processing command and arguments for baseName,
+// or an empty command if the engine writes PDF directly
+func (e *Engine) PostProcessArgs(baseName string) (string, []string) {
+	if len(e.PostProcess) == 0 {
+		return "", nil
+	}
+	args := append([]string{}, e.PostProcess[1:]...)
+	return e.PostProcess[0], append(args, baseName+e.OutputExt)
+}
+
+// DetectEngine picks an engine for compiler=auto. Magic comments in the main file win;
+// otherwise package usage across the main file and other sources decides,
+// falling back to DefaultEngine. Returns the engine name and the reason.
+func DetectEngine(mainSource []byte, sources map[string][]byte) (string, string) {
+	if m := magicProgramRe.FindSubmatch(mainSource); m != nil {
+		name := strings.ToLower(string(m[1]))
+		if alias, ok := engineAliases[name]; ok {
+			name = alias
+		}
+		return name, fmt.Sprintf("magic comment %q", strings.TrimSpace(string(m[0])))
+	}
+
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	texts := []string{StripTeXComments(string(mainSource))}
+	for _, name := range names {
+		texts = append(texts, StripTeXComments(string(sources[name])))
+	}
+
+	used := make(map[string]bool)
+	for _, text := range texts {
+		for _, m := range packageRe.FindAllStringSubmatch(text, -1) {
+			for _, pkg := range strings.Split(m[1], ",") {
+				used[strings.TrimSpace(pkg)] = true
+			}
+		}
+		if directLuaRe.MatchString(text) {
+			return "lualatex", "uses \\directlua"
+		}
+	}
+
+	for _, pe := range packageEngines {
+		if used[pe.pkg] {
+			return pe.engine, fmt.Sprintf("uses package %s", pe.pkg)
+		}
+	}
+
+	return DefaultEngine, "no engine-specific magic comments or packages found"
+}
+
+// StripTeXComments removes % comments, keeping escaped \% characters
+func StripTeXComments(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		for j := 0; j < len(line); j++ {
+			if line[j] == '\\' {
+				j++
+				continue
+			}
+			if line[j] == '%' {
+				lines[i] = line[:j]
+				break
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,108 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Characters with a special meaning in TeX and their text-mode replacements
+var latexEscaper = strings.NewReplacer(
+	`\`, `\textbackslash{}`,
+	`{`, `\{`,
+	`}`, `\}`,
+	`$`, `\$`,
+	`&`, `\&`,
+	`#`, `\#`,
+	`^`, `\textasciicircum{}`,
+	`_`, `\_`,
+	`%`, `\%`,
+	`~`, `\textasciitilde{}`,
+	"\r\n", " ",
+	"\n", " ",
+	"\r", " ",
+)
+
+// Letters-only commands that the LaTeX kernel, the article, report and book
+// classes or the engines define, which \newcommand refuses to redefine
+var kernelCommands = commandSet(`
+	a b c d H i j k l o r t u v L O P S AA aa AE ae OE oe ss TeX LaTeX LaTeXe
+	and author date thanks title maketitle today
+	part chapter section subsection subsubsection paragraph subparagraph appendix
+	abstract caption label ref pageref cite nocite item footnote footnotetext marginpar
+	bibliography bibliographystyle tableofcontents listoffigures listoftables index
+	document figure table center flushleft flushright quote quotation verse
+	itemize enumerate description list tabular tabbing array equation eqnarray
+	minipage picture verbatim thebibliography theindex titlepage trivlist
+	abstractname appendixname bibname chaptername contentsname figurename
+	indexname listfigurename listtablename partname refname tablename
+	begin end input include includeonly documentclass usepackage
+	newcommand renewcommand providecommand newenvironment renewenvironment
+	def edef gdef xdef let relax the par space empty null
+	emph textbf textit textrm textsf texttt textsc textsl textup textmd textnormal
+	bf it rm sf tt sc sl em bfseries itshape rmfamily sffamily ttfamily
+	mdseries upshape slshape scshape normalfont
+	tiny scriptsize footnotesize small normalsize large Large LARGE huge Huge
+	mbox fbox makebox framebox parbox raisebox rule hline cline line vline
+	linebreak newline newpage clearpage cleardoublepage pagebreak nopagebreak
+	hspace vspace hfill vfill smallskip medskip bigskip indent noindent centering
+	raggedright raggedleft quad qquad ldots dots cdots copyright pounds dag ddag
+	alph Alph arabic roman Roman fnsymbol value stepcounter setcounter addtocounter
+	newcounter refstepcounter pagenumbering pagestyle thispagestyle
+	count dimen skip box hbox vbox vtop kern penalty mark number year month day time
+	left right over above atop choose of if else fi or ifx ifnum ifdim
+	char accent show message span cr crcr halign valign noalign omit
+	hskip vskip hss vss hfil vfil global long outer expandafter noexpand
+	csname endcsname string jobname fontname meaning uppercase lowercase
+`)
+
+// Further commands defined by a document class
+var classCommands = map[string]map[string]bool{
+	"letter": commandSet(`
+		address signature opening closing location telephone name cc encl ps
+		makelabels ccname enclname headtoname pagename
+	`),
+}
+
+func commandSet(names string) map[string]bool {
+	set := make(map[string]bool)
+	for _, name := range strings.Fields(names) {
+		set[name] = true
+	}
+	return set
+}
+
+// PredefinedCommand reports whether \name is already defined in a document of
+// the given class, so a macro of that name can't be injected. Commands from
+// other classes and from packages aren't known.
+func PredefinedCommand(name, class string) bool {
+	return kernelCommands[name] || classCommands[class][name]
+}
+
+// EscapeLaTeX turns arbitrary text into LaTeX that typesets it literally
+func EscapeLaTeX(text string) string {
+	return latexEscaper.Replace(text)
+}
+
+// wrapperSource generates a document that starts with preamble, defines the macros
+// and inputs mainPath. \newcommand refuses to redefine existing commands, so kernel
+// and package macros can't be overridden (callers reject the ones PredefinedCommand
+// knows); documents should use \providecommand for defaults.
+func wrapperSource(preamble string, macros map[string]string, mainPath string) []byte {
+	names := make([]string, 0, len(macros))
+	for name := range macros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("% Generated by tex-compiler\n")
+	if preamble != "" {
+		b.WriteString(strings.TrimSuffix(preamble, "\n") + "\n")
+	}
+	for _, name := range names {
+		fmt.Fprintf(&b, "\\newcommand{\\%s}{%s}\n", name, EscapeLaTeX(macros[name]))
+	}
+	fmt.Fprintf(&b, "\\input{%s}\n", mainPath)
+	return []byte(b.String())
+}
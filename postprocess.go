@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// qpdf page ranges such as 1-3,5,r1 or 1-z:odd
+var pageRangeRe = regexp.MustCompile(`^[0-9rz][0-9a-z,:-]{0,199}$`)
+
+// A post-processing step needs a tool this server doesn't have
+type missingToolError struct {
+	tool string
+}
+
+func (e *missingToolError) Error() string {
+	return fmt.Sprintf("%s is not installed on this server", e.tool)
+}
+
+// parsePostProcess decodes the 'postprocess' form field, a JSON array of steps.
+// Merge steps name their PDFs by the file name of an 'attachment' upload.
+// Returns nil if the field is empty.
+func parsePostProcess(raw string, uploads []savedUpload) (*PostProcess, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	var steps []*PDFStep
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&steps); err != nil {
+		return nil, fmt.Errorf("postprocess must be a JSON array of steps: %w", err)
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("postprocess has no steps")
+	}
+	if len(steps) > MaxPDFSteps {
+		return nil, fmt.Errorf("at most %d postprocess steps are allowed", MaxPDFSteps)
+	}
+
+	attachments := make(map[string]string)
+	for _, upload := range uploads {
+		if upload.Field != "attachment" {
+			continue
+		}
+		if _, ok := attachments[upload.Name]; ok {
+			return nil, fmt.Errorf("attachment %s was uploaded twice", upload.Name)
+		}
+		attachments[upload.Name] = upload.Path
+	}
+	if len(attachments) > MaxAttachments {
+		return nil, fmt.Errorf("at most %d attachments are allowed", MaxAttachments)
+	}
+
+	tools := make(map[string]bool)
+	for i, step := range steps {
+		if err := step.validate(attachments); err != nil {
+			return nil, fmt.Errorf("step %d (%s): %w", i+1, step.Op, err)
+		}
+		tools[step.tool()] = true
+	}
+	for tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			return nil, &missingToolError{tool: tool}
+		}
+	}
+
+	return &PostProcess{Steps: steps, Attachments: attachments}, nil
+}
+
+// Writes the response for a parsePostProcess error
+func respondPostProcessError(w http.ResponseWriter, err error) {
+	var missingTool *missingToolError
+	if errors.As(err, &missingTool) {
+		http.Error(w, fmt.Sprintf("Invalid postprocess: %v", err), http.StatusNotImplemented)
+		return
+	}
+	http.Error(w, fmt.Sprintf("Invalid postprocess: %v", err), http.StatusBadRequest)
+}
+
+func (s *PDFStep) validate(attachments map[string]string) error {
+	switch s.Op {
+	case "pages":
+		if !pageRangeRe.MatchString(s.Pages) {
+			return fmt.Errorf("invalid page range %q", s.Pages)
+		}
+	case "merge":
+		names := append(append([]string{}, s.Before...), s.After...)
+		if len(names) == 0 {
+			return fmt.Errorf("name the attachments to insert in before or after")
+		}
+		for _, name := range names {
+			path, ok := attachments[name]
+			if !ok {
+				return fmt.Errorf("attachment %s was not uploaded", name)
+			}
+			if !isPDF(path) {
+				return fmt.Errorf("attachment %s is not a PDF", name)
+			}
+		}
+	case "compress":
+		switch s.Quality {
+		case "", "lossless", "screen", "ebook", "printer", "prepress":
+		default:
+			return fmt.Errorf("invalid quality %q: use lossless, screen, ebook, printer or prepress", s.Quality)
+		}
+	case "linearize":
+	case "metadata":
+		if s.Title == "" && s.Author == "" && s.Subject == "" && s.Keywords == "" {
+			return fmt.Errorf("set at least one of title, author, subject or keywords")
+		}
+	default:
+		return fmt.Errorf("unknown operation: use pages, merge, compress, linearize or metadata")
+	}
+	return nil
+}
+
+// Lossy compression rewrites the PDF with ghostscript, everything else uses qpdf
+func (s *PDFStep) tool() string {
+	if s.Op == "compress" && s.Quality != "" && s.Quality != "lossless" {
+		return "gs"
+	}
+	return "qpdf"
+}
+
+// Apply runs the steps in order on the PDF at path, replacing it
+func (pp *PostProcess) Apply(ctx context.Context, path string, logWriter func(string)) error {
+	ctx, cancel := context.WithTimeout(ctx, PostProcessTimeout)
+	defer cancel()
+
+	for i, step := range pp.Steps {
+		logWriter(fmt.Sprintf("Post-processing step %d: %s", i+1, step.Op))
+		output := fmt.Sprintf("%s.step%d.pdf", strings.TrimSuffix(path, ".pdf"), i+1)
+		err := step.run(ctx, path, output, pp.Attachments, logWriter)
+		if err == nil {
+			err = os.Rename(output, path)
+		}
+		if err != nil {
+			os.Remove(output)
+			if ctx.Err() == context.DeadlineExceeded {
+				err = fmt.Errorf("timed out")
+			}
+			return fmt.Errorf("%s: %w", step.Op, err)
+		}
+	}
+	return nil
+}
+
+func (pp *PostProcess) removeAttachments() {
+	for _, path := range pp.Attachments {
+		os.Remove(path)
+	}
+}
+
+func (s *PDFStep) run(ctx context.Context, input, output string, attachments map[string]string, logWriter func(string)) error {
+	switch s.Op {
+	case "pages":
+		return runPDFTool(ctx, logWriter, "qpdf", "--warning-exit-0", input, "--pages", input, s.Pages, "--", output)
+
+	case "merge":
+		// The document stays the primary input, so its metadata and outlines are kept
+		args := []string{"--warning-exit-0", input, "--pages"}
+		for _, name := range s.Before {
+			args = append(args, attachments[name])
+		}
+		args = append(args, input)
+		for _, name := range s.After {
+			args = append(args, attachments[name])
+		}
+		return runPDFTool(ctx, logWriter, "qpdf", append(args, "--", output)...)
+
+	case "linearize":
+		return runPDFTool(ctx, logWriter, "qpdf", "--warning-exit-0", "--linearize", input, output)
+
+	case "compress":
+		if s.tool() == "qpdf" {
+			return runPDFTool(ctx, logWriter, "qpdf", "--warning-exit-0", "--object-streams=generate",
+				"--compress-streams=y", "--recompress-flate", "--compression-level=9", input, output)
+		}
+		// ghostscript expands % in the output file name
+		return runPDFTool(ctx, logWriter, "gs", "-q", "-dSAFER", "-dBATCH", "-dNOPAUSE", "-sDEVICE=pdfwrite",
+			"-dCompatibilityLevel=1.5", "-dPDFSETTINGS=/"+s.Quality,
+			"-sOutputFile="+strings.ReplaceAll(output, "%", "%%"), input)
+
+	case "metadata":
+		return s.setMetadata(ctx, input, output, logWriter)
+	}
+	return fmt.Errorf("unknown operation")
+}
+
+// setMetadata updates the document information dictionary through qpdf's JSON
+// interface, keeping the fields it doesn't set and leaving the content untouched
+func (s *PDFStep) setMetadata(ctx context.Context, input, output string, logWriter func(string)) error {
+	header, trailer, err := qpdfObject(ctx, input, "trailer")
+	if err != nil {
+		return err
+	}
+
+	var infoRef string
+	info := make(map[string]json.RawMessage)
+	if raw, ok := trailer["/Info"]; ok {
+		if err := json.Unmarshal(raw, &infoRef); err != nil {
+			return fmt.Errorf("unexpected /Info in trailer: %s", raw)
+		}
+		if _, info, err = qpdfObject(ctx, input, infoRef); err != nil {
+			return err
+		}
+	}
+
+	fields := map[string]string{"/Title": s.Title, "/Author": s.Author, "/Subject": s.Subject, "/Keywords": s.Keywords}
+	for key, value := range fields {
+		if value != "" {
+			info[key], _ = json.Marshal("u:" + value)
+		}
+	}
+
+	objects := make(map[string]interface{})
+	if infoRef == "" {
+		// No information dictionary yet: add one as a new object
+		var maxID int
+		if err := json.Unmarshal(header["maxobjectid"], &maxID); err != nil {
+			return fmt.Errorf("qpdf did not report maxobjectid")
+		}
+		infoRef = fmt.Sprintf("%d 0 R", maxID+1)
+		trailer["/Info"], _ = json.Marshal(infoRef)
+		objects["trailer"] = map[string]interface{}{"value": trailer}
+	}
+	objects["obj:"+infoRef] = map[string]interface{}{"value": info}
+
+	update, err := json.Marshal(map[string]interface{}{"qpdf": []interface{}{header, objects}})
+	if err != nil {
+		return err
+	}
+	updatePath := output + ".json"
+	if err := os.WriteFile(updatePath, update, 0644); err != nil {
+		return err
+	}
+	defer os.Remove(updatePath)
+
+	return runPDFTool(ctx, logWriter, "qpdf", "--warning-exit-0", input, "--update-from-json="+updatePath, output)
+}
+
+// qpdfObject reads the trailer (ref "trailer") or an indirect object (ref "7 0 R")
+// of a PDF from qpdf's JSON v2 output, returning the JSON header and the object's
+// dictionary with its values as qpdf encodes them
+func qpdfObject(ctx context.Context, path, ref string) (map[string]json.RawMessage, map[string]json.RawMessage, error) {
+	object, key := "trailer", "trailer"
+	if ref != "trailer" {
+		var id, generation int
+		if _, err := fmt.Sscanf(ref, "%d %d R", &id, &generation); err != nil {
+			return nil, nil, fmt.Errorf("invalid object reference %q", ref)
+		}
+		object, key = fmt.Sprintf("%d,%d", id, generation), "obj:"+ref
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "qpdf", "--json=2", "--json-key=qpdf", "--json-object="+object, path)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, nil, fmt.Errorf("qpdf failed to read %s: %v: %s", key, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var document struct {
+		QPDF []map[string]json.RawMessage `json:"qpdf"`
+	}
+	if err := json.Unmarshal(output, &document); err != nil || len(document.QPDF) != 2 {
+		return nil, nil, fmt.Errorf("unexpected qpdf JSON output")
+	}
+	var wrapper struct {
+		Value map[string]json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(document.QPDF[1][key], &wrapper); err != nil || wrapper.Value == nil {
+		return nil, nil, fmt.Errorf("%s is not a dictionary", key)
+	}
+	return document.QPDF[0], wrapper.Value, nil
+}
+
+func runPDFTool(ctx context.Context, logWriter func(string), command string, args ...string) error {
+	output, err := exec.CommandContext(ctx, command, args...).CombinedOutput()
+	if len(output) > 0 {
+		logWriter(fmt.Sprintf("%s output:\n%s", command, output))
+	}
+	if err != nil {
+		return fmt.Errorf("%s failed: %w", command, err)
+	}
+	return nil
+}
+
+// Reports whether the file starts like a PDF; the header may follow up to 1 KB of junk
+func isPDF(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	head := make([]byte, 1024)
+	n, _ := io.ReadFull(file, head)
+	return bytes.Contains(head[:n], []byte("%PDF-"))
+}
+
+// Routes /pdf/{operation}. POST /pdf/process runs a post-processing chain on an
+// uploaded PDF without compiling anything.
+func handlePDF(w http.ResponseWriter, r *http.Request) {
+	if strings.TrimPrefix(r.URL.Path, "/pdf/") != "process" {
+		http.Error(w, "Unknown PDF operation", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if rejectIfOverloaded(w) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxArchiveSize)
+	uploads, err := receiveUploads(r, []string{"file", "attachment"})
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, fmt.Sprintf("Upload exceeds %d MB", MaxArchiveSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	defer func() {
+		for _, upload := range uploads {
+			os.Remove(upload.Path)
+		}
+	}()
+
+	upload := firstUpload(uploads, "file")
+	if upload.Path == "" {
+		http.Error(w, "No file uploaded", http.StatusBadRequest)
+		return
+	}
+	if !isPDF(upload.Path) {
+		http.Error(w, "Only PDF files are allowed", http.StatusBadRequest)
+		return
+	}
+
+	postProcess, err := parsePostProcess(r.FormValue("postprocess"), uploads)
+	if err != nil {
+		respondPostProcessError(w, err)
+		return
+	}
+	if postProcess == nil {
+		http.Error(w, "No postprocess steps given", http.StatusBadRequest)
+		return
+	}
+
+	jobID := generateID()
+	logFile, err := createJobLog(jobID)
+	if err != nil {
+		http.Error(w, "Failed to create log file", http.StatusInternalServerError)
+		return
+	}
+	defer logFile.Close()
+	logFile.Write(fmt.Sprintf("Post-processing %s", upload.Name))
+	defer func() { go scheduleCleanup(jobID) }()
+
+	result := &CompileResult{
+		Success: false,
+		LogsURL: "/logs/" + jobID + ".log",
+		JobID:   jobID,
+	}
+
+	// Post-processing takes a compilation slot while it runs
+	job := &CompileJob{ID: jobID, MainFile: upload.Name, StartTime: time.Now(), Timeout: PostProcessTimeout}
+	runningJobs.Add(job)
+	defer runningJobs.Remove(jobID)
+	err = postProcess.Apply(r.Context(), upload.Path, logFile.Write)
+	if err == nil {
+		err = copyFile(upload.Path, filepath.Join(FilesDir, jobID+".pdf"))
+	}
+	status := http.StatusOK
+	if err != nil {
+		logFile.Write(fmt.Sprintf("Post-processing failed: %v", err))
+		log.Printf("❌ [%s] PDF post-processing failed: %v", jobID, err)
+		result.Message = fmt.Sprintf("PDF post-processing failed: %v", err)
+		status = http.StatusInternalServerError
+	} else {
+		logFile.Write("Post-processing completed successfully")
+		log.Printf("✅ [%s] PDF post-processed in %v", jobID, time.Since(job.StartTime).Round(time.Millisecond))
+		result.Success = true
+		result.Message = "Post-processing completed successfully"
+		result.PDFURL = "/files/" + jobID + ".pdf"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
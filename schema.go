@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The subset of JSON Schema used to validate template data. Documents are
+// decoded with json.Decoder.UseNumber, so numbers arrive as json.Number.
+type Schema struct {
+	Type                 string             `json:"type,omitempty"` // object, array, string, number, integer, boolean or null
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// Invalid template data, with one entry per violation
+type SchemaError struct {
+	Errors []string
+}
+
+func (e *SchemaError) Error() string {
+	return strings.Join(e.Errors, "; ")
+}
+
+// compile checks the schema and prepares its patterns
+func (s *Schema) compile(path string) error {
+	switch s.Type {
+	case "", "object", "array", "string", "number", "integer", "boolean", "null":
+	default:
+		return fmt.Errorf("%s: unknown type %q", path, s.Type)
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid pattern: %w", path, err)
+		}
+		s.pattern = re
+	}
+	for name, property := range s.Properties {
+		if err := property.compile(path + "." + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile(path + "[]")
+	}
+	return nil
+}
+
+// Validate checks value against the schema, reporting every violation
+func (s *Schema) Validate(value interface{}) error {
+	var errs []string
+	s.validate(value, "data", &errs)
+	if len(errs) > 0 {
+		return &SchemaError{Errors: errs}
+	}
+	return nil
+}
+
+// Numbers replaces the json.Number values in validated data by Go numbers that
+// templates can format and compare: float64 where the schema says number, int64
+// where it says integer, and either by value where the schema doesn't say
+func (s *Schema) Numbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, item := range v {
+			var property *Schema
+			if s != nil {
+				property = s.Properties[name]
+			}
+			v[name] = property.Numbers(item)
+		}
+	case []interface{}:
+		var items *Schema
+		if s != nil {
+			items = s.Items
+		}
+		for i, item := range v {
+			v[i] = items.Numbers(item)
+		}
+	case json.Number:
+		if s == nil || s.Type != "number" {
+			if n, err := v.Int64(); err == nil {
+				return n
+			}
+		}
+		n, _ := v.Float64()
+		return n
+	}
+	return value
+}
+
+func (s *Schema) validate(value interface{}, path string, errs *[]string) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	if s.Type != "" && !hasJSONType(value, s.Type) {
+		fail("must be %s %s", article(s.Type), s.Type)
+		return
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, allowed := range s.Enum {
+			if jsonEqual(value, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			choices := make([]string, len(s.Enum))
+			for i, allowed := range s.Enum {
+				encoded, _ := json.Marshal(allowed)
+				choices[i] = string(encoded)
+			}
+			fail("must be one of %s", strings.Join(choices, ", "))
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				*errs = append(*errs, fmt.Sprintf("%s.%s: is required", path, name))
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if property, ok := s.Properties[name]; ok {
+				property.validate(v[name], path+"."+name, errs)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				*errs = append(*errs, fmt.Sprintf("%s.%s: is not allowed", path, name))
+			}
+		}
+
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			fail("must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i), errs)
+			}
+		}
+
+	case string:
+		length := len([]rune(v))
+		if s.MinLength != nil && length < *s.MinLength {
+			fail("must have a length of at least %d", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			fail("must have a length of at most %d", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("must match %s", s.Pattern)
+		}
+
+	case json.Number:
+		n, _ := v.Float64()
+		if s.Minimum != nil && n < *s.Minimum {
+			fail("must be at least %s", strconv.FormatFloat(*s.Minimum, 'f', -1, 64))
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			fail("must be at most %s", strconv.FormatFloat(*s.Maximum, 'f', -1, 64))
+		}
+	}
+}
+
+func hasJSONType(value interface{}, typ string) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return typ == "object"
+	case []interface{}:
+		return typ == "array"
+	case string:
+		return typ == "string"
+	case bool:
+		return typ == "boolean"
+	case nil:
+		return typ == "null"
+	case json.Number:
+		if typ == "number" {
+			return true
+		}
+		n, err := v.Float64()
+		return typ == "integer" && err == nil && n == math.Trunc(n)
+	}
+	return false
+}
+
+// Compares decoded JSON values, treating numbers by value
+func jsonEqual(a, b interface{}) bool {
+	if x, ok := a.(json.Number); ok {
+		if y, ok := b.(json.Number); ok {
+			xf, _ := x.Float64()
+			yf, _ := y.Float64()
+			return xf == yf
+		}
+		return false
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func article(typ string) string {
+	if strings.ContainsRune("aeiou", rune(typ[0])) {
+		return "an"
+	}
+	return "a"
+}
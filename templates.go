@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"tex-compiler/pipeline"
+)
+
+// Function appended to every template action, so that data is typeset literally
+const escapeFuncName = "latexEscape"
+
+// Delimiters used unless the manifest sets its own; {{ }} clashes with TeX grouping
+var defaultTemplateDelims = []string{"<<", ">>"}
+
+// Contents of a template's template.json
+type templateManifest struct {
+	Description string   `json:"description"`
+	Main        string   `json:"main"`      // Root document, default main.tex
+	Compiler    string   `json:"compiler"`  // Engine name or auto, default DefaultCompiler
+	Templates   []string `json:"templates"` // Files rendered with the data, default every .tex file
+	Delims      []string `json:"delims"`    // Action delimiters, default << and >>
+	Schema      *Schema  `json:"schema"`
+}
+
+func NewTemplateRegistry() *TemplateRegistry {
+	return &TemplateRegistry{
+		templates: make(map[string]*Template),
+	}
+}
+
+// LoadDir registers every subdirectory of dir containing a template.json. A
+// missing directory is not an error; the server then has no templates.
+func (tr *TemplateRegistry) LoadDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, entry.Name(), TemplateManifest)); os.IsNotExist(err) {
+			continue
+		}
+		tmpl, err := loadTemplate(entry.Name(), filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("template %s: %w", entry.Name(), err)
+		}
+		tr.mu.Lock()
+		tr.templates[tmpl.Name] = tmpl
+		tr.mu.Unlock()
+	}
+	return nil
+}
+
+func (tr *TemplateRegistry) Get(name string) (*Template, bool) {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	tmpl, ok := tr.templates[name]
+	return tmpl, ok
+}
+
+// List returns the templates sorted by name
+func (tr *TemplateRegistry) List() []*Template {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+
+	list := make([]*Template, 0, len(tr.templates))
+	for _, tmpl := range tr.templates {
+		list = append(list, tmpl)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Resolves the templates directory, allowing an override via TEX_TEMPLATES_DIR
+func templatesDirPath() string {
+	if dir := os.Getenv("TEX_TEMPLATES_DIR"); dir != "" {
+		return filepath.Clean(dir)
+	}
+	return TemplatesDir
+}
+
+// Reads the manifest in dir and parses the templated sources
+func loadTemplate(name, dir string) (*Template, error) {
+	data, err := os.ReadFile(filepath.Join(dir, TemplateManifest))
+	if err != nil {
+		return nil, err
+	}
+	var manifest templateManifest
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", TemplateManifest, err)
+	}
+
+	if manifest.Main == "" {
+		manifest.Main = "main.tex"
+	}
+	if !strings.HasSuffix(manifest.Main, ".tex") {
+		manifest.Main += ".tex"
+	}
+	if manifest.Compiler == "" {
+		manifest.Compiler = DefaultCompiler
+	}
+	if manifest.Delims == nil {
+		manifest.Delims = defaultTemplateDelims
+	}
+	if len(manifest.Delims) != 2 || manifest.Delims[0] == "" || manifest.Delims[1] == "" {
+		return nil, errors.New("delims must be a pair of non-empty strings")
+	}
+	if manifest.Schema == nil {
+		manifest.Schema = &Schema{Type: "object"}
+	}
+	if err := manifest.Schema.compile("data"); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+
+	if manifest.Templates == nil {
+		texSources, err := readDirTexFiles(dir)
+		if err != nil {
+			return nil, err
+		}
+		for name := range texSources {
+			manifest.Templates = append(manifest.Templates, name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(manifest.Main))); err != nil {
+		return nil, fmt.Errorf("main file %s not found", manifest.Main)
+	}
+
+	tmpl := &Template{
+		Name:        name,
+		Dir:         dir,
+		Description: manifest.Description,
+		MainFile:    strings.TrimSuffix(manifest.Main, ".tex"),
+		Compiler:    manifest.Compiler,
+		Schema:      manifest.Schema,
+		sources:     make(map[string]*template.Template),
+	}
+	for _, relPath := range manifest.Templates {
+		relPath = path.Clean(relPath)
+		if path.IsAbs(relPath) || strings.HasPrefix(relPath, "../") {
+			return nil, fmt.Errorf("template file %s is outside the template directory", relPath)
+		}
+		content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(relPath)))
+		if err != nil {
+			return nil, err
+		}
+		source, err := parseLaTeXTemplate(relPath, string(content), manifest.Delims)
+		if err != nil {
+			return nil, err
+		}
+		tmpl.sources[relPath] = source
+	}
+	return tmpl, nil
+}
+
+// parseLaTeXTemplate parses text as a Go template whose actions all have their
+// output escaped for LaTeX, the way html/template escapes for HTML. Actions
+// that only declare variables print nothing and are left alone.
+func parseLaTeXTemplate(name, text string, delims []string) (*template.Template, error) {
+	tmpl, err := template.New(name).
+		Delims(delims[0], delims[1]).
+		Funcs(template.FuncMap{escapeFuncName: latexEscapeValue}).
+		Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			escapeActions(t.Tree.Root)
+		}
+	}
+	return tmpl, nil
+}
+
+// Appends the escape function to the pipeline of every printing action below node
+func escapeActions(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			escapeActions(child)
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) == 0 {
+			escape := &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos}
+			escape.Args = []parse.Node{parse.NewIdentifier(escapeFuncName).SetPos(n.Pos)}
+			n.Pipe.Cmds = append(n.Pipe.Cmds, escape)
+		}
+	case *parse.IfNode:
+		escapeActions(n.List)
+		escapeActions(n.ElseList)
+	case *parse.RangeNode:
+		escapeActions(n.List)
+		escapeActions(n.ElseList)
+	case *parse.WithNode:
+		escapeActions(n.List)
+		escapeActions(n.ElseList)
+	}
+}
+
+// Formats a template value as literal LaTeX text. Missing values print nothing.
+func latexEscapeValue(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return pipeline.EscapeLaTeX(fmt.Sprint(value))
+}
+
+// Render validates data against the template's schema and executes its sources
+func (t *Template) Render(data interface{}) (*RenderedTemplate, error) {
+	if err := t.Schema.Validate(data); err != nil {
+		return nil, err
+	}
+	data = t.Schema.Numbers(data)
+
+	rendered := &RenderedTemplate{Template: t, Files: make(map[string][]byte)}
+	for relPath, source := range t.sources {
+		var buf bytes.Buffer
+		if err := source.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		rendered.Files[relPath] = buf.Bytes()
+	}
+	return rendered, nil
+}
+
+// WriteTo copies the template's files into destDir, with the rendered sources
+// in place of their templates. The manifest is left out.
+func (rt *RenderedTemplate) WriteTo(destDir string) error {
+	err := filepath.Walk(rt.Template.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(rt.Template.Dir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(destDir, relPath)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if relPath == TemplateManifest {
+			return nil
+		}
+		if _, ok := rt.Files[filepath.ToSlash(relPath)]; ok {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+	if err != nil {
+		return err
+	}
+
+	for relPath, content := range rt.Files {
+		target := filepath.Join(destDir, filepath.FromSlash(relPath))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, content, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// .tex sources of the rendered project, for engine detection
+func (rt *RenderedTemplate) texSources() (map[string][]byte, error) {
+	sources, err := readDirTexFiles(rt.Template.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for relPath, content := range rt.Files {
+		if strings.HasSuffix(relPath, ".tex") {
+			sources[relPath] = content
+		}
+	}
+	return sources, nil
+}
+
+// Public description of a template
+func (t *Template) info() map[string]interface{} {
+	return map[string]interface{}{
+		"name":        t.Name,
+		"description": t.Description,
+		"main":        t.MainFile + ".tex",
+		"compiler":    t.Compiler,
+		"schema":      t.Schema,
+		"render_url":  "/templates/" + t.Name + "/render",
+	}
+}
+
+// GET /templates lists the registered templates
+func handleTemplates(w http.ResponseWriter, r *http.Request) {
+	list := []map[string]interface{}{}
+	for _, tmpl := range templates.List() {
+		list = append(list, tmpl.info())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"templates": list,
+	})
+}
+
+// Routes /templates/{name} and /templates/{name}/render
+func handleTemplate(w http.ResponseWriter, r *http.Request) {
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/templates/"), "/")
+	tmpl, ok := templates.Get(name)
+	if !ok {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tmpl.info())
+	case "render":
+		handleTemplateRender(w, r, tmpl)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// POST /templates/{name}/render compiles the template with the JSON body's data.
+// The other body fields are the /compile options that make sense for templates.
+func handleTemplateRender(w http.ResponseWriter, r *http.Request, tmpl *Template) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if rejectIfOverloaded(w) {
+		return
+	}
+
+	var request struct {
+		Data        interface{} `json:"data"`
+		Mode        string      `json:"mode"`
+		Jobname     string      `json:"jobname"`
+		CallbackURL string      `json:"callback_url"`
+		Profile     string      `json:"profile"`
+		Lang        string      `json:"lang"`
+		Stats       bool        `json:"stats"`
+		Lint        bool        `json:"lint"`
+	}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxTemplateData))
+	decoder.UseNumber()
+	if err := decoder.Decode(&request); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("Request too large (max %d MB)", MaxTemplateData>>20), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Invalid JSON body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if request.Data == nil {
+		request.Data = map[string]interface{}{}
+	}
+
+	rendered, err := tmpl.Render(request.Data)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		response := map[string]interface{}{
+			"error":   "Template rendering failed",
+			"message": err.Error(),
+		}
+		var schemaErr *SchemaError
+		if errors.As(err, &schemaErr) {
+			response["error"] = "Invalid template data"
+			response["message"] = fmt.Sprintf("The data does not match the schema of template %s", tmpl.Name)
+			response["errors"] = schemaErr.Errors
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	texSources, err := rendered.texSources()
+	if err != nil {
+		http.Error(w, "Failed to read template files", http.StatusInternalServerError)
+		return
+	}
+
+	// newCompileJob reads its options from the form
+	r.Form = url.Values{"compiler": {tmpl.Compiler}}
+	for key, value := range map[string]string{
+		"mode":         request.Mode,
+		"jobname":      request.Jobname,
+		"callback_url": request.CallbackURL,
+		"profile":      request.Profile,
+		"lang":         request.Lang,
+	} {
+		if value != "" {
+			r.Form.Set(key, value)
+		}
+	}
+	if request.Stats {
+		r.Form.Set("stats", "true")
+	}
+	if request.Lint {
+		r.Form.Set("lint", "true")
+	}
+
+	job := newCompileJob(w, r, []string{tmpl.MainFile}, texSources)
+	if job == nil {
+		return
+	}
+	job.Template = rendered
+	runCompileJob(w, job, nil)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderTemplateNumbers(t *testing.T) {
+	dir := t.TempDir()
+	manifest := `{"schema": {"type": "object", "properties": {
+		"qty": {"type": "integer", "minimum": 1},
+		"price": {"type": "number"},
+		"items": {"type": "array", "items": {"type": "object", "properties": {"weight": {"type": "number"}}}}
+	}}}`
+	main := `<< printf "%.2f" .price >> x << .qty >><< if gt .qty 1 >> (bulk)<< end >>` +
+		`<< range .items >> << printf "%05.1f" .weight >><< end >>`
+	if err := os.WriteFile(filepath.Join(dir, TemplateManifest), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "main.tex"), []byte(main), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := loadTemplate("invoice", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Decoded the way handleTemplateRender decodes request bodies
+	var data interface{}
+	decoder := json.NewDecoder(strings.NewReader(`{"qty": 3, "price": 12.5, "items": [{"weight": 2}, {"weight": 0.75}]}`))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+
+	rendered, err := tmpl.Render(data)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if got, want := string(rendered.Files["main.tex"]), "12.50 x 3 (bulk) 002.0 000.8"; got != want {
+		t.Errorf("rendered %q, want %q", got, want)
+	}
+}
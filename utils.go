@@ -2,14 +2,11 @@ package main
 
 import (
 	"archive/zip"
-	"bytes"
-	"context"
 	"crypto/rand"
 	"fmt"
 	"io"
 	"math/big"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 )
@@ -24,31 +21,7 @@ func generateID() string {
 	return string(result)
 }
 
-func isValidCompiler(compiler string) bool {
-	return compiler == "pdflatex" || compiler == "lualatex" || compiler == "xelatex"
-}
-
-func runCommand(ctx context.Context, dir, command string, args ...string) (string, error) {
-	cmd := exec.CommandContext(ctx, command, args...)
-	cmd.Dir = dir
-
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &out
-
-	err := cmd.Run()
-	if ctx.Err() == context.DeadlineExceeded {
-		return out.String(), fmt.Errorf("command %s timed out", command)
-	}
-	return out.String(), err
-}
-
-func extractZip(data []byte, destDir string) error {
-	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
-	if err != nil {
-		return fmt.Errorf("failed to open zip reader: %w", err)
-	}
-
+func extractZip(r *zip.Reader, destDir string) error {
 	for _, f := range r.File {
 		// Security check for zip slip
 		path := filepath.Join(destDir, f.Name)
@@ -83,10 +56,70 @@ func extractZip(data []byte, destDir string) error {
 		if err != nil {
 			return err
 		}
+
+		// Keep archive timestamps so stale build artifacts (e.g. .bbl) can be detected
+		if !f.Modified.IsZero() {
+			os.Chtimes(path, f.Modified, f.Modified)
+		}
 	}
 	return nil
 }
 
+// Extracts the archive at zipPath into destDir
+func extractUpload(zipPath, destDir string) error {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return fmt.Errorf("failed to open zip reader: %w", err)
+	}
+	defer r.Close()
+	return extractZip(&r.Reader, destDir)
+}
+
+// Reads every .tex file in the archive, keyed by its path inside the archive
+func readZipTexFiles(r *zip.Reader) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || !strings.HasSuffix(strings.ToLower(f.Name), ".tex") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		files[f.Name] = content
+	}
+	return files, nil
+}
+
+// Reads every .tex file under dir, keyed by its slash-separated path relative to dir
+func readDirTexFiles(dir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(strings.ToLower(path), ".tex") {
+			return nil
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(relPath)] = content
+		return nil
+	})
+	return files, err
+}
+
 func copyFile(src, dst string) error {
 	sourceFile, err := os.Open(src)
 	if err != nil {
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Header carrying the hex HMAC-SHA256 of the request body, as "sha256=<hex>"
+const SignatureHeader = "X-TeX-Compiler-Signature-256"
+
+func NewAsyncJobs() *AsyncJobs {
+	return &AsyncJobs{
+		jobs:    make(map[string]*CompileJob),
+		results: make(map[string]*CompileResult),
+	}
+}
+
+func (aj *AsyncJobs) Add(job *CompileJob) {
+	aj.mu.Lock()
+	defer aj.mu.Unlock()
+	aj.jobs[job.ID] = job
+}
+
+func (aj *AsyncJobs) Remove(jobID string) {
+	aj.mu.Lock()
+	defer aj.mu.Unlock()
+	delete(aj.jobs, jobID)
+	delete(aj.results, jobID)
+}
+
+func (aj *AsyncJobs) SetResult(jobID string, result *CompileResult) {
+	aj.mu.Lock()
+	defer aj.mu.Unlock()
+	aj.results[jobID] = result
+}
+
+// UpdateCallback applies update to the job's delivery state under the tracker lock
+func (aj *AsyncJobs) UpdateCallback(jobID string, update func(*CallbackDelivery)) {
+	aj.mu.Lock()
+	defer aj.mu.Unlock()
+	if job, ok := aj.jobs[jobID]; ok {
+		update(job.Callback)
+	}
+}
+
+// Status returns a snapshot of the job's state, result and delivery
+func (aj *AsyncJobs) Status(jobID string) (map[string]interface{}, bool) {
+	aj.mu.RLock()
+	defer aj.mu.RUnlock()
+
+	job, ok := aj.jobs[jobID]
+	if !ok {
+		return nil, false
+	}
+
+	status := map[string]interface{}{
+		"job_id":   job.ID,
+		"status":   "running",
+		"callback": *job.Callback,
+	}
+	if result, ok := aj.results[jobID]; ok {
+		status["status"] = "completed"
+		status["result"] = result
+	}
+	return status, true
+}
+
+// Shared secret for signing callbacks; callbacks are disabled without it
+func webhookSecret() string {
+	return os.Getenv("TEX_WEBHOOK_SECRET")
+}
+
+// Hosts callbacks may reach even on loopback or private addresses, from the
+// comma-separated TEX_WEBHOOK_ALLOWED_HOSTS
+func callbackHostAllowed(host string) bool {
+	for _, allowed := range strings.Split(os.Getenv("TEX_WEBHOOK_ALLOWED_HOSTS"), ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && strings.EqualFold(allowed, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether ip is somewhere a client may point a callback: not this host,
+// the local network or link-local addresses such as cloud metadata endpoints
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+func validateCallbackURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("scheme must be http or https")
+	}
+	if u.Host == "" {
+		return errors.New("missing host")
+	}
+
+	// Obvious internal targets are refused up front; hostnames are checked
+	// again when delivery connects, against the addresses they resolve to
+	host := u.Hostname()
+	if callbackHostAllowed(host) {
+		return nil
+	}
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return errors.New("host must not be local")
+	}
+	if ip := net.ParseIP(host); ip != nil && !publicIP(ip) {
+		return errors.New("host must not be a loopback, private or link-local address")
+	}
+	return nil
+}
+
+// Client for callback deliveries. Every connection is checked against the
+// address actually dialed, so a hostname can't resolve (or be rebound) to an
+// internal address between validation and delivery.
+var callbackClient = &http.Client{
+	Timeout: CallbackTimeout,
+	Transport: &http.Transport{
+		DialContext:         dialCallback,
+		TLSHandshakeTimeout: CallbackTimeout,
+	},
+}
+
+func dialCallback(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: CallbackTimeout, Control: checkCallbackAddress}
+	if host, _, err := net.SplitHostPort(address); err == nil && callbackHostAllowed(host) {
+		dialer.Control = nil
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+func checkCallbackAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("refusing to deliver to internal address %s", host)
+	}
+	return nil
+}
+
+func signPayload(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(webhookSecret()))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverCallback records the result and POSTs it to the job's callback URL,
+// retrying with exponential backoff. The job is forgotten CleanupDelay after
+// delivery settles.
+func deliverCallback(job *CompileJob, result *CompileResult) {
+	asyncJobs.SetResult(job.ID, result)
+	defer func() {
+		time.Sleep(CleanupDelay)
+		asyncJobs.Remove(job.ID)
+	}()
+
+	payload, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("⚠️ [%s] Failed to encode callback payload: %v", job.ID, err)
+		return
+	}
+	signature := signPayload(payload)
+
+	backoff := CallbackBackoff
+	for attempt := 1; attempt <= CallbackAttempts; attempt++ {
+		err := postCallback(callbackClient, job.Callback.URL, job.ID, payload, signature)
+
+		asyncJobs.UpdateCallback(job.ID, func(cb *CallbackDelivery) {
+			cb.Attempts = attempt
+			if err == nil {
+				now := time.Now().UTC()
+				cb.Status = "delivered"
+				cb.LastError = ""
+				cb.DeliveredAt = &now
+				return
+			}
+			cb.LastError = err.Error()
+			if attempt == CallbackAttempts {
+				cb.Status = "failed"
+			}
+		})
+
+		if err == nil {
+			log.Printf("📤 [%s] Callback delivered (attempt %d)", job.ID, attempt)
+			return
+		}
+		log.Printf("⚠️ [%s] Callback attempt %d/%d failed: %v", job.ID, attempt, CallbackAttempts, err)
+
+		if attempt < CallbackAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func postCallback(client *http.Client, callbackURL, jobID string, payload []byte, signature string) error {
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tex-compiler-webhook")
+	req.Header.Set("X-TeX-Compiler-Job", jobID)
+	req.Header.Set(SignatureHeader, signature)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+	return nil
+}
+
+// GET /jobs/{id} reports the state of a job and, for callback jobs, its result and delivery
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	jobID := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	if jobID == "" {
+		http.Error(w, "Job not specified", http.StatusBadRequest)
+		return
+	}
+
+	status, ok := asyncJobs.Status(jobID)
+	if !ok && runningJobs.Has(jobID) {
+		status, ok = map[string]interface{}{"job_id": jobID, "status": "running"}, true
+	}
+	if !ok {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
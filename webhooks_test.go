@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A stand-in callback receiver answering each request with the next status
+type callbackReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []receivedCallback
+}
+
+type receivedCallback struct {
+	at        time.Time
+	body      []byte
+	signature string
+	jobID     string
+}
+
+func (cr *callbackReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.requests = append(cr.requests, receivedCallback{
+		at:        time.Now(),
+		body:      body,
+		signature: r.Header.Get(SignatureHeader),
+		jobID:     r.Header.Get("X-TeX-Compiler-Job"),
+	})
+	status := http.StatusOK
+	if len(cr.statuses) > 0 {
+		status, cr.statuses = cr.statuses[0], cr.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (cr *callbackReceiver) received() []receivedCallback {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return append([]receivedCallback(nil), cr.requests...)
+}
+
+// Starts a delivery for a new callback job and returns the job
+func startDelivery(t *testing.T, id, callbackURL string, result *CompileResult) *CompileJob {
+	t.Helper()
+	job := &CompileJob{ID: id, Callback: &CallbackDelivery{URL: callbackURL, Status: "pending"}}
+	asyncJobs.Add(job)
+	t.Cleanup(func() { asyncJobs.Remove(id) })
+	go deliverCallback(job, result)
+	return job
+}
+
+// Polls GET /jobs/{id} until the callback leaves the pending state
+func waitForDelivery(t *testing.T, id string, timeout time.Duration) map[string]interface{} {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		recorder := httptest.NewRecorder()
+		handleJob(recorder, httptest.NewRequest(http.MethodGet, "/jobs/"+id, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("GET /jobs/%s = %d: %s", id, recorder.Code, recorder.Body)
+		}
+		var status map[string]interface{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+			t.Fatalf("GET /jobs/%s: %v", id, err)
+		}
+		if status["callback"].(map[string]interface{})["status"] != "pending" {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("callback of %s still pending after %v: %v", id, timeout, status)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestDeliverCallbackSignsAndRetries(t *testing.T) {
+	t.Setenv("TEX_WEBHOOK_SECRET", "test-secret")
+	t.Setenv("TEX_WEBHOOK_ALLOWED_HOSTS", "127.0.0.1")
+
+	receiver := &callbackReceiver{statuses: []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	result := &CompileResult{Success: true, Message: "Compilation completed successfully", JobID: "cbretry", PDFURL: "/files/cbretry.pdf"}
+	startDelivery(t, "cbretry", server.URL, result)
+	status := waitForDelivery(t, "cbretry", 10*time.Second)
+
+	requests := receiver.received()
+	if len(requests) != 3 {
+		t.Fatalf("got %d requests, want 3", len(requests))
+	}
+	for i, request := range requests {
+		mac := hmac.New(sha256.New, []byte("test-secret"))
+		mac.Write(request.body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); !hmac.Equal([]byte(request.signature), []byte(want)) {
+			t.Errorf("request %d: signature %q, want %q", i+1, request.signature, want)
+		}
+		if request.jobID != "cbretry" {
+			t.Errorf("request %d: job header %q", i+1, request.jobID)
+		}
+		var payload CompileResult
+		if err := json.Unmarshal(request.body, &payload); err != nil || payload.PDFURL != result.PDFURL {
+			t.Errorf("request %d: payload %s", i+1, request.body)
+		}
+	}
+
+	// Backoff starts at CallbackBackoff and doubles
+	if gap := requests[1].at.Sub(requests[0].at); gap < CallbackBackoff {
+		t.Errorf("first retry after %v, want at least %v", gap, CallbackBackoff)
+	}
+	if gap := requests[2].at.Sub(requests[1].at); gap < 2*CallbackBackoff {
+		t.Errorf("second retry after %v, want at least %v", gap, 2*CallbackBackoff)
+	}
+
+	callback := status["callback"].(map[string]interface{})
+	if callback["status"] != "delivered" || callback["attempts"] != float64(3) || callback["last_error"] != nil || callback["delivered_at"] == nil {
+		t.Errorf("callback state %v, want delivered after 3 attempts", callback)
+	}
+	if status["status"] != "completed" || status["result"].(map[string]interface{})["pdf_url"] != result.PDFURL {
+		t.Errorf("job state %v, want completed with the result", status)
+	}
+}
+
+func TestDeliverCallbackGivesUp(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits out the full retry schedule")
+	}
+	t.Setenv("TEX_WEBHOOK_SECRET", "test-secret")
+	t.Setenv("TEX_WEBHOOK_ALLOWED_HOSTS", "127.0.0.1")
+
+	receiver := &callbackReceiver{statuses: []int{500, 500, 500, 500, 500}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	startDelivery(t, "cbfail", server.URL, &CompileResult{Success: false, Message: "LaTeX compilation failed", JobID: "cbfail"})
+	status := waitForDelivery(t, "cbfail", 30*time.Second)
+
+	if n := len(receiver.received()); n != CallbackAttempts {
+		t.Errorf("got %d requests, want %d", n, CallbackAttempts)
+	}
+	callback := status["callback"].(map[string]interface{})
+	if callback["status"] != "failed" || callback["attempts"] != float64(CallbackAttempts) {
+		t.Errorf("callback state %v, want failed after %d attempts", callback, CallbackAttempts)
+	}
+	if lastError, _ := callback["last_error"].(string); !strings.Contains(lastError, "500") {
+		t.Errorf("last_error %q, want the 500 status", lastError)
+	}
+}
+
+func TestCallbacksRefuseInternalAddresses(t *testing.T) {
+	t.Setenv("TEX_WEBHOOK_SECRET", "test-secret")
+	t.Setenv("TEX_WEBHOOK_ALLOWED_HOSTS", "")
+
+	for _, rawURL := range []string{
+		"http://localhost:8080/hook",
+		"http://127.0.0.1/hook",
+		"http://[::1]/hook",
+		"http://10.1.2.3/hook",
+		"http://192.168.0.10/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://0.0.0.0/hook",
+		"ftp://example.com/hook",
+	} {
+		if err := validateCallbackURL(rawURL); err == nil {
+			t.Errorf("validateCallbackURL(%q) accepted an internal or invalid URL", rawURL)
+		}
+	}
+	if err := validateCallbackURL("https://hooks.example.com/tex"); err != nil {
+		t.Errorf("validateCallbackURL rejected a public URL: %v", err)
+	}
+
+	// A hostname resolving to an internal address is caught when connecting
+	receiver := &callbackReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	hostnameURL := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	err := postCallback(callbackClient, hostnameURL, "cbinternal", []byte("{}"), signPayload([]byte("{}")))
+	if err == nil || !strings.Contains(err.Error(), "internal address") {
+		t.Errorf("delivery to %s: err = %v, want a refused internal address", hostnameURL, err)
+	}
+	if n := len(receiver.received()); n != 0 {
+		t.Errorf("receiver got %d requests", n)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// texcount's total lines, e.g. "Words in text: 250"
+	texcountTotalRe = regexp.MustCompile(`^(Words in text|Words in headers|Words outside text \(captions, etc\.\)|Number of headers|Number of floats/tables/figures|Number of math inlines|Number of math displayed): (\d+)$`)
+
+	// texcount's subcount lines, e.g. "100+2+12 (1/1/2/0) Section: Introduction"
+	texcountSectionRe = regexp.MustCompile(`^(\d+)\+(\d+)\+(\d+) \((\d+)/(\d+)/(\d+)/(\d+)\) (.*)$`)
+)
+
+// Routes /analyze/{analysis}. POST /analyze/wordcount counts the words of an
+// uploaded project with texcount without compiling it.
+func handleAnalyze(w http.ResponseWriter, r *http.Request) {
+	if strings.TrimPrefix(r.URL.Path, "/analyze/") != "wordcount" {
+		http.Error(w, "Unknown analysis", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := exec.LookPath("texcount"); err != nil {
+		http.Error(w, "texcount is not installed on this server", http.StatusNotImplemented)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxArchiveSize)
+	uploadPath, uploadName, err := receiveUpload(r)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, fmt.Sprintf("Upload exceeds %d MB", MaxArchiveSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	if uploadPath == "" {
+		http.Error(w, "No file uploaded", http.StatusBadRequest)
+		return
+	}
+	defer os.Remove(uploadPath)
+
+	project := readUploadedProject(w, r, uploadPath, uploadName)
+	if project == nil {
+		return
+	}
+
+	tempDir := filepath.Join(WorkDir, generateID())
+	defer os.RemoveAll(tempDir)
+	projectDir, err := project.writeTo(tempDir, uploadPath)
+	if err != nil {
+		log.Printf("❌ Failed to unpack project for word count: %v", err)
+		http.Error(w, "Failed to unpack the project", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), TexcountTimeout)
+	defer cancel()
+	var documents []*DocumentStats
+	for _, mainFile := range project.MainFiles {
+		stats, err := countWords(ctx, projectDir, mainFile)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Word count of %s failed: %v", mainFile, err), http.StatusUnprocessableEntity)
+			return
+		}
+		stats.Document = mainFile
+		documents = append(documents, stats)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"documents": documents})
+}
+
+// countWords runs texcount on the main file, following \input and \include, and
+// returns the totals with a breakdown by part, chapter and section
+func countWords(ctx context.Context, projectDir, mainFile string) (*DocumentStats, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "texcount", "-merge", "-sub=section", "-utf8", "-nocol", mainFile+".tex")
+	cmd.Dir = projectDir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("texcount timed out")
+		}
+		return nil, fmt.Errorf("texcount failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return parseTexcount(stdout.String())
+}
+
+func parseTexcount(output string) (*DocumentStats, error) {
+	stats := &DocumentStats{}
+	found := false
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+
+		if strings.HasPrefix(line, "!!!") {
+			stats.Warnings = append(stats.Warnings, strings.TrimSpace(strings.Trim(line, "!")))
+			continue
+		}
+
+		if m := texcountTotalRe.FindStringSubmatch(line); m != nil {
+			found = true
+			n, _ := strconv.Atoi(m[2])
+			switch m[1] {
+			case "Words in text":
+				stats.Totals.Text = n
+			case "Words in headers":
+				stats.Totals.Headers = n
+			case "Words outside text (captions, etc.)":
+				stats.Totals.Captions = n
+			case "Number of headers":
+				stats.Totals.HeaderCount = n
+			case "Number of floats/tables/figures":
+				stats.Totals.FloatCount = n
+			case "Number of math inlines":
+				stats.Totals.InlineMath = n
+			case "Number of math displayed":
+				stats.Totals.DisplayMath = n
+			}
+			continue
+		}
+
+		if m := texcountSectionRe.FindStringSubmatch(line); m != nil {
+			var n [7]int
+			for i := range n {
+				n[i], _ = strconv.Atoi(m[i+1])
+			}
+			section := &SectionStats{
+				Level: "top", // Text before the first heading
+				WordCounts: WordCounts{
+					Text:        n[0],
+					Headers:     n[1],
+					Captions:    n[2],
+					HeaderCount: n[3],
+					FloatCount:  n[4],
+					InlineMath:  n[5],
+					DisplayMath: n[6],
+				},
+			}
+			section.Words = section.Text + section.Headers + section.Captions
+			if level, title, ok := strings.Cut(m[8], ": "); ok {
+				section.Level, section.Title = strings.ToLower(level), title
+			} else if m[8] != "_top_" {
+				section.Title = m[8]
+			}
+			stats.Sections = append(stats.Sections, section)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("unexpected texcount output")
+	}
+	stats.Totals.Words = stats.Totals.Text + stats.Totals.Headers + stats.Totals.Captions
+	return stats, nil
+}
+
+// documentStats counts the words of a compiled document for the 'stats' option
+// and adds the page count of its PDF. Statistics are informational, so failures
+// are logged and leave the counts out.
+func documentStats(ctx context.Context, projectDir, mainFile, pdfPath string, logWriter func(string)) *DocumentStats {
+	ctx, cancel := context.WithTimeout(ctx, TexcountTimeout)
+	defer cancel()
+
+	logWriter("Counting words with texcount")
+	stats, err := countWords(ctx, projectDir, mainFile)
+	if err != nil {
+		logWriter(fmt.Sprintf("Word count failed: %v", err))
+		return nil
+	}
+	for _, warning := range stats.Warnings {
+		logWriter(fmt.Sprintf("texcount: %s", warning))
+	}
+
+	pages, err := pdfPageCount(ctx, pdfPath)
+	if err != nil {
+		logWriter(fmt.Sprintf("Page count failed: %v", err))
+	}
+	stats.Pages = pages
+	return stats
+}
+
+func pdfPageCount(ctx context.Context, path string) (int, error) {
+	if _, err := exec.LookPath("qpdf"); err != nil {
+		return 0, fmt.Errorf("qpdf is not installed on this server")
+	}
+	output, err := exec.CommandContext(ctx, "qpdf", "--show-npages", path).Output()
+	if err != nil {
+		return 0, fmt.Errorf("qpdf failed: %v", err)
+	}
+	return strconv.Atoi(strings.TrimSpace(string(output)))
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errTooManyWorkspaces = errors.New("too many workspaces")
+
+func NewWorkspaces() *Workspaces {
+	return &Workspaces{
+		workspaces: make(map[string]*Workspace),
+	}
+}
+
+func (ws *Workspaces) Create() (*Workspace, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if len(ws.workspaces) >= MaxWorkspaces {
+		return nil, errTooManyWorkspaces
+	}
+
+	id := generateID()
+	workspace := &Workspace{
+		ID:        id,
+		Dir:       filepath.Join(WorkspacesDir, id),
+		CreatedAt: time.Now(),
+		lastUsed:  time.Now(),
+	}
+	if err := os.MkdirAll(workspace.Dir, 0755); err != nil {
+		return nil, err
+	}
+	ws.workspaces[id] = workspace
+	return workspace, nil
+}
+
+// Get returns the workspace and marks it as used
+func (ws *Workspaces) Get(id string) (*Workspace, bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	workspace, ok := ws.workspaces[id]
+	if ok {
+		workspace.lastUsed = time.Now()
+	}
+	return workspace, ok
+}
+
+// Remove deletes the workspace and its files, waiting for a running compile to finish
+func (ws *Workspaces) Remove(id string) bool {
+	ws.mu.Lock()
+	workspace, ok := ws.workspaces[id]
+	delete(ws.workspaces, id)
+	ws.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+	workspace.mu.Lock()
+	defer workspace.mu.Unlock()
+	os.RemoveAll(workspace.Dir)
+	return true
+}
+
+// ExpireIdle removes workspaces unused for longer than WorkspaceIdleTTL.
+// Workspaces that are busy compiling are left for the next round.
+func (ws *Workspaces) ExpireIdle() {
+	ws.mu.Lock()
+	var expired []*Workspace
+	for id, workspace := range ws.workspaces {
+		if time.Since(workspace.lastUsed) < WorkspaceIdleTTL || !workspace.mu.TryLock() {
+			continue
+		}
+		delete(ws.workspaces, id)
+		expired = append(expired, workspace)
+	}
+	ws.mu.Unlock()
+
+	for _, workspace := range expired {
+		os.RemoveAll(workspace.Dir)
+		workspace.mu.Unlock()
+		log.Printf("🧹 [%s] Idle workspace removed", workspace.ID)
+	}
+}
+
+func (ws *Workspaces) expireLoop() {
+	for range time.Tick(time.Minute) {
+		ws.ExpireIdle()
+	}
+}
+
+// Resolves a slash-separated path inside the workspace, rejecting traversal
+func (w *Workspace) path(relPath string) (string, error) {
+	path := filepath.Join(w.Dir, filepath.FromSlash(relPath))
+	if !strings.HasPrefix(path, filepath.Clean(w.Dir)+string(os.PathSeparator)) {
+		return "", fmt.Errorf("invalid file path: %s", relPath)
+	}
+	return path, nil
+}
+
+// Lists workspace files as slash-separated paths
+func (w *Workspace) files() ([]string, error) {
+	var files []string
+	err := filepath.Walk(w.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(w.Dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(relPath))
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// POST /workspaces creates a workspace, optionally seeded from a ZIP in the 'file' field
+func handleWorkspaces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var zipData []byte
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(MaxUploadSize); err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		if file, _, err := r.FormFile("file"); err == nil {
+			zipData, err = io.ReadAll(file)
+			file.Close()
+			if err != nil {
+				http.Error(w, "Failed to read uploaded file", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	workspace, err := workspaces.Create()
+	if errors.Is(err, errTooManyWorkspaces) {
+		http.Error(w, fmt.Sprintf("Maximum %d workspaces reached", MaxWorkspaces), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to create workspace: %v", err)
+		http.Error(w, "Failed to create workspace", http.StatusInternalServerError)
+		return
+	}
+
+	if zipData != nil {
+		if err := extractWorkspaceZip(workspace, zipData); err != nil {
+			workspaces.Remove(workspace.ID)
+			http.Error(w, fmt.Sprintf("Failed to extract ZIP file: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	log.Printf("📂 [%s] Workspace created", workspace.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"workspace_id": workspace.ID,
+		"expires_in":   WorkspaceIdleTTL.String(),
+	})
+}
+
+// Extracts a seed archive into the workspace, dropping a single wrapping folder
+func extractWorkspaceZip(workspace *Workspace, zipData []byte) error {
+	zipReader, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		return err
+	}
+	root := archiveRoot(zipReader)
+	if root == "" {
+		return extractZip(zipReader, workspace.Dir)
+	}
+
+	// Extract next to the workspace and move the wrapped folder into place
+	staging := workspace.Dir + ".seed"
+	defer os.RemoveAll(staging)
+	if err := extractZip(zipReader, staging); err != nil {
+		return err
+	}
+	if err := os.Remove(workspace.Dir); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(staging, root), workspace.Dir)
+}
+
+// Routes /workspaces/{id}, /workspaces/{id}/files/{path} and /workspaces/{id}/compile
+func handleWorkspace(w http.ResponseWriter, r *http.Request) {
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/workspaces/"), "/")
+	workspace, ok := workspaces.Get(id)
+	if !ok {
+		http.Error(w, "Workspace not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case rest == "":
+		handleWorkspaceRoot(w, r, workspace)
+	case rest == "compile":
+		handleWorkspaceCompile(w, r, workspace)
+	case strings.HasPrefix(rest, "files/"):
+		handleWorkspaceFile(w, r, workspace, strings.TrimPrefix(rest, "files/"))
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func handleWorkspaceRoot(w http.ResponseWriter, r *http.Request, workspace *Workspace) {
+	switch r.Method {
+	case http.MethodGet:
+		workspace.mu.Lock()
+		files, err := workspace.files()
+		workspace.mu.Unlock()
+		if err != nil {
+			http.Error(w, "Failed to list workspace files", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"workspace_id": workspace.ID,
+			"created_at":   workspace.CreatedAt.UTC(),
+			"files":        files,
+		})
+
+	case http.MethodDelete:
+		workspaces.Remove(workspace.ID)
+		log.Printf("🧹 [%s] Workspace deleted", workspace.ID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleWorkspaceFile(w http.ResponseWriter, r *http.Request, workspace *Workspace, relPath string) {
+	path, err := workspace.path(relPath)
+	if relPath == "" || err != nil {
+		http.Error(w, "Invalid file path", http.StatusBadRequest)
+		return
+	}
+
+	workspace.mu.Lock()
+	defer workspace.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			http.Error(w, "Failed to create directory", http.StatusInternalServerError)
+			return
+		}
+		outFile, err := os.Create(path)
+		if err != nil {
+			http.Error(w, "Failed to write file", http.StatusInternalServerError)
+			return
+		}
+		_, err = io.Copy(outFile, http.MaxBytesReader(w, r.Body, MaxUploadSize))
+		outFile.Close()
+		if err != nil {
+			os.Remove(path)
+			http.Error(w, "Failed to write file", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if err := os.Remove(path); os.IsNotExist(err) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to delete file", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Compiles the workspace in place, keeping .aux, .bbl and other artifacts for the next run
+func handleWorkspaceCompile(w http.ResponseWriter, r *http.Request, workspace *Workspace) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if rejectIfOverloaded(w) {
+		return
+	}
+
+	// Held until the job's goroutine has returned, which may outlive this request
+	if !workspace.mu.TryLock() {
+		http.Error(w, "Workspace is already compiling", http.StatusConflict)
+		return
+	}
+
+	job := newWorkspaceJob(w, r, workspace)
+	if job == nil {
+		workspace.mu.Unlock()
+		return
+	}
+	runCompileJob(w, job, workspace.mu.Unlock)
+}
+
+// Builds a compile job for the workspace. On invalid input it writes an error
+// response and returns nil.
+func newWorkspaceJob(w http.ResponseWriter, r *http.Request, workspace *Workspace) *CompileJob {
+	texSources, err := readDirTexFiles(workspace.Dir)
+	if err != nil {
+		http.Error(w, "Failed to read workspace files", http.StatusInternalServerError)
+		return nil
+	}
+	if len(texSources) == 0 {
+		http.Error(w, "No .tex files found in the workspace", http.StatusBadRequest)
+		return nil
+	}
+
+	mainFiles, ok := mainFilesFromRequest(w, r, texSources, "")
+	if !ok {
+		return nil
+	}
+
+	job := newCompileJob(w, r, mainFiles, texSources)
+	if job != nil {
+		job.Workspace = workspace
+	}
+	return job
+}